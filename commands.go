@@ -0,0 +1,1284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gosuri/uiprogress"
+	"github.com/gotmc/libusb"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/usb"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pollInterval is the time between two scans of the USB bus in watch mode.
+const pollInterval = time.Second
+
+// cli holds the global options shared by all commands.
+type cli struct {
+	vid    uint16
+	pid    uint16
+	json   bool
+	status *os.File
+	// watch keeps running and processes every device that is attached, a
+	// location is only processed again after it was empty for rearm.
+	watch bool
+	rearm time.Duration
+	// selectors, zero values match every device
+	bus      int
+	portPath string
+	sn       string
+	// bootLoader is downloaded to devices in Maskrom mode before a command
+	bootLoader *rkusb.RkLoader
+	// timeout replaces the default timeouts of all commands when not 0
+	timeout time.Duration
+	retries int
+	ctx     *libusb.Context
+}
+
+type identity struct {
+	sn   string
+	imei string
+	uid  string
+	bt   string
+	mac  string
+}
+
+// matchingDevices returns all USB devices with the configured VID/PID that
+// match the bus, port path and serial number selectors.
+func (c *cli) matchingDevices() ([]*libusb.Device, error) {
+	devices, err := c.locatedDevices()
+	if err != nil || len(c.sn) == 0 {
+		return devices, err
+	}
+
+	var matching []*libusb.Device
+	for _, device := range devices {
+		// devices that can not be read, e.g. because they are busy, never
+		// match a serial number
+		sn, err := readSerialNo(device)
+		if err == nil && sn == c.sn {
+			matching = append(matching, device)
+		}
+	}
+	return matching, nil
+}
+
+// locatedDevices returns all USB devices with the configured VID/PID that
+// match the bus and port path selectors, the serial number is not checked.
+func (c *cli) locatedDevices() ([]*libusb.Device, error) {
+	if c.ctx == nil {
+		ctx, err := libusb.NewContext()
+		if err != nil {
+			return nil, err
+		}
+		c.ctx = ctx
+	}
+
+	devices, err := c.ctx.GetDeviceList()
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []*libusb.Device
+	for _, device := range devices {
+		dd, err := device.GetDeviceDescriptor()
+		if err != nil {
+			return nil, err
+		}
+		if !c.matchesId(dd) {
+			continue
+		}
+		if !c.matchesLocation(device) {
+			continue
+		}
+		matching = append(matching, device)
+	}
+	return matching, nil
+}
+
+// matchesId checks the vendor and product id, without a product id every
+// known Rockchip device matches.
+func (c *cli) matchesId(dd *libusb.DeviceDescriptor) bool {
+	if dd.VendorID != c.vid {
+		return false
+	}
+	if c.pid != 0 {
+		return dd.ProductID == c.pid
+	}
+	_, ok := rkusb.LookupDevice(dd.VendorID, dd.ProductID)
+	return ok
+}
+
+// matchesLocation checks the bus and port path selectors. The port path
+// matches with and without the leading bus number, 1-1.4 and 1.4 select the
+// same device on bus 1.
+func (c *cli) matchesLocation(device *libusb.Device) bool {
+	if c.bus == 0 && len(c.portPath) == 0 {
+		return true
+	}
+	bus, err := device.GetBusNumber()
+	if err != nil {
+		return false
+	}
+	if c.bus != 0 && bus != c.bus {
+		return false
+	}
+	if len(c.portPath) == 0 {
+		return true
+	}
+	location, err := usb.Location(device)
+	if err != nil {
+		return false
+	}
+	return location == c.portPath || location == fmt.Sprintf("%d-%s", bus, c.portPath)
+}
+
+// readSerialNo returns the serial number stored in the IDB of the device.
+func readSerialNo(device *libusb.Device) (string, error) {
+	transport, err := usb.Open(device)
+	if err != nil {
+		return "", err
+	}
+	rkDev := rkusb.CreateRkDevice(transport)
+	defer rkDev.Close()
+
+	err = rkDev.ReadDeviceData()
+	if err != nil {
+		return "", err
+	}
+	return rkDev.GetSerialNo(), nil
+}
+
+// deviceName identifies a device by its USB location.
+func deviceName(device *libusb.Device) string {
+	location, err := usb.Location(device)
+	if err != nil {
+		return "?"
+	}
+	return location
+}
+
+type deviceResult struct {
+	name string
+	err  error
+}
+
+// reenumerateTimeout is how long a device may take to show up in loader
+// mode after the boot download.
+const reenumerateTimeout = 10 * time.Second
+
+// runDevice opens the device and calls fn with it. A device in Maskrom mode
+// gets c.bootLoader downloaded first when one was given. With readData the
+// chip, flash and IDB information is read before.
+func (c *cli) runDevice(device *libusb.Device, readData bool, fn func(name string, rkDev *rkusb.RkDevice) error) error {
+	name := deviceName(device)
+	transport, err := usb.Open(device)
+	if err != nil {
+		return err
+	}
+	rkDev := c.createDevice(transport)
+	defer func() {
+		rkDev.Close()
+	}()
+
+	if rkDev.Mode() == rkusb.ModeMaskrom && c.bootLoader != nil {
+		err = rkDev.DownloadBoot(c.bootLoader)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: Boot loader downloaded\n", name)
+
+		// the loader enumerates again at the same location, the handle of
+		// the Maskrom device is stale afterwards
+		rkDev.Close()
+		loaderDevice := c.waitForLoader(name)
+		if loaderDevice == nil {
+			return fmt.Errorf("loader did not show up within %v after the boot download", reenumerateTimeout)
+		}
+		transport, err := usb.Open(loaderDevice)
+		if err != nil {
+			return err
+		}
+		rkDev = c.createDevice(transport)
+	}
+
+	if readData {
+		err = rkDev.ReadDeviceData()
+		if err != nil {
+			return modeHint(err)
+		}
+	}
+	return modeHint(fn(name, &rkDev))
+}
+
+// createDevice applies the timeout and retry options to a new device.
+func (c *cli) createDevice(transport rkusb.Transport) rkusb.RkDevice {
+	rkDev := rkusb.CreateRkDevice(transport)
+	if c.timeout != 0 {
+		for opCode := range rkusb.DefaultTimeouts {
+			rkDev.SetTimeout(opCode, c.timeout)
+		}
+	}
+	rkDev.SetRetries(c.retries)
+	return rkDev
+}
+
+// waitForLoader returns the device in loader mode at the location, nil when
+// none shows up within reenumerateTimeout.
+func (c *cli) waitForLoader(location string) *libusb.Device {
+	for start := time.Now(); time.Since(start) < reenumerateTimeout; time.Sleep(pollInterval) {
+		devices, err := c.ctx.GetDeviceList()
+		if err != nil {
+			return nil
+		}
+		for _, device := range devices {
+			dd, err := device.GetDeviceDescriptor()
+			if err != nil || !c.matchesId(dd) || !c.matchesLocation(device) || deviceName(device) != location {
+				continue
+			}
+			mode, err := usb.Mode(device)
+			if err == nil && mode == rkusb.ModeLoader {
+				return device
+			}
+		}
+	}
+	return nil
+}
+
+// modeHint explains how to get a device in Maskrom mode into loader mode.
+func modeHint(err error) error {
+	if errors.Is(err, rkusb.ErrMaskromMode) {
+		return fmt.Errorf("%w, run download-boot or pass --boot-loader <loader.bin>", err)
+	}
+	return err
+}
+
+// forEachDevice calls fn for every matching device, one after another. A
+// failing device does not stop the others.
+func (c *cli) forEachDevice(readData bool, fn func(name string, rkDev *rkusb.RkDevice) error) error {
+	if c.watch {
+		return c.watchDevices(readData, fn)
+	}
+
+	devices, err := c.matchingDevices()
+	if err != nil {
+		return err
+	}
+
+	results := make([]deviceResult, len(devices))
+	for i, device := range devices {
+		results[i] = deviceResult{deviceName(device), c.runDevice(device, readData, fn)}
+	}
+	return c.summary(results)
+}
+
+// forOneDevice calls fn for the only matching device, commands that write to
+// a single file refuse to run on several devices.
+func (c *cli) forOneDevice(readData bool, fn func(name string, rkDev *rkusb.RkDevice) error) error {
+	devices, err := c.matchingDevices()
+	if err != nil {
+		return err
+	}
+	if len(devices) > 1 {
+		return fmt.Errorf("found %d devices, select one with --bus, --port-path or --sn", len(devices))
+	}
+
+	results := make([]deviceResult, len(devices))
+	for i, device := range devices {
+		results[i] = deviceResult{deviceName(device), c.runDevice(device, readData, fn)}
+	}
+	return c.summary(results)
+}
+
+// forEachDeviceParallel calls fn for every matching device, each device in
+// its own goroutine, and returns the result of every device.
+func (c *cli) forEachDeviceParallel(readData bool, fn func(name string, rkDev *rkusb.RkDevice) error) ([]deviceResult, error) {
+	devices, err := c.matchingDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]deviceResult, len(devices))
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		wg.Add(1)
+		go func(i int, device *libusb.Device) {
+			defer wg.Done()
+			results[i] = deviceResult{deviceName(device), c.runDevice(device, readData, fn)}
+		}(i, device)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// watchDevices polls the USB bus and calls fn for every device that shows up
+// at a new location, each device in its own goroutine. A location that was
+// processed is skipped until it has been empty for c.rearm, so a device that
+// re-enumerates after a reset is not processed twice. With --sn the serial
+// number of a new device is read once and kept until the device is gone,
+// devices that are busy or done are never opened by the poll. It only returns
+// when the USB bus can not be read.
+func (c *cli) watchDevices(readData bool, fn func(name string, rkDev *rkusb.RkDevice) error) error {
+	fmt.Fprintln(c.status, "Waiting for devices")
+
+	busy := map[string]bool{}
+	// processed locations and when a device was last seen there
+	done := map[string]time.Time{}
+	// serial numbers of the attached devices by location
+	serials := map[string]string{}
+	results := make(chan deviceResult)
+
+	for {
+		devices, err := c.locatedDevices()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		present := map[string]*libusb.Device{}
+		for _, device := range devices {
+			present[deviceName(device)] = device
+		}
+		for location, seen := range done {
+			if present[location] != nil {
+				done[location] = now
+			} else if now.Sub(seen) > c.rearm {
+				delete(done, location)
+			}
+		}
+
+		for location := range serials {
+			if present[location] == nil {
+				delete(serials, location)
+			}
+		}
+
+		for location, device := range present {
+			if _, ok := done[location]; ok || busy[location] {
+				continue
+			}
+			if len(c.sn) > 0 {
+				sn, ok := serials[location]
+				if !ok {
+					// a device that can not be read yet is tried again
+					// with the next poll
+					sn, err = readSerialNo(device)
+					if err != nil {
+						continue
+					}
+					serials[location] = sn
+				}
+				if sn != c.sn {
+					continue
+				}
+			}
+			busy[location] = true
+			fmt.Fprintf(c.status, "%s: started\n", location)
+			go func(location string, device *libusb.Device) {
+				results <- deviceResult{location, c.runDevice(device, readData, fn)}
+			}(location, device)
+		}
+
+		select {
+		case result := <-results:
+			if result.err != nil {
+				fmt.Fprintf(c.status, "%s: FAILED %v\n", result.name, result.err)
+			} else {
+				fmt.Fprintf(c.status, "%s: OK\n", result.name)
+			}
+			delete(busy, result.name)
+			done[result.name] = time.Now()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// summary prints the result of every device when more than one device was
+// processed and returns an error if any of them failed.
+func (c *cli) summary(results []deviceResult) error {
+	if len(results) == 0 {
+		return errors.New("no device found")
+	}
+	if len(results) == 1 {
+		return results[0].err
+	}
+
+	failed := 0
+	fmt.Fprintln(c.status, "Summary:")
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+			fmt.Fprintf(c.status, "%8s: FAILED %v\n", result.name, result.err)
+		} else {
+			fmt.Fprintf(c.status, "%8s: OK\n", result.name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d devices failed", failed, len(results))
+	}
+	return nil
+}
+
+// deviceEntry is a line of the list command.
+type deviceEntry struct {
+	Bus       int    `json:"bus"`
+	Location  string `json:"location"`
+	VendorId  string `json:"vendor_id"`
+	ProductId string `json:"product_id"`
+	Chip      string `json:"chip"`
+	Mode      string `json:"mode"`
+	SerialNo  string `json:"sn"`
+}
+
+func (c *cli) list() error {
+	devices, err := c.matchingDevices()
+	if err != nil {
+		return err
+	}
+
+	if !c.json {
+		fmt.Printf("%3s  %-12s  %-9s  %-14s  %-7s  %s\n", "BUS", "LOCATION", "ID", "CHIP", "MODE", "SN")
+	}
+	for _, device := range devices {
+		bus, err := device.GetBusNumber()
+		if err != nil {
+			return err
+		}
+		dd, err := device.GetDeviceDescriptor()
+		if err != nil {
+			return err
+		}
+		mode, err := usb.Mode(device)
+		if err != nil {
+			return err
+		}
+		entry := deviceEntry{
+			Bus:       bus,
+			Location:  deviceName(device),
+			VendorId:  fmt.Sprintf("%04x", dd.VendorID),
+			ProductId: fmt.Sprintf("%04x", dd.ProductID),
+			Chip:      "unknown",
+			Mode:      mode.String(),
+			SerialNo:  "-",
+		}
+		known, ok := rkusb.LookupDevice(dd.VendorID, dd.ProductID)
+		if ok {
+			entry.Chip = known.Chip
+		}
+		// the serial number is only readable with a loader running
+		if mode == rkusb.ModeLoader {
+			sn, err := readSerialNo(device)
+			if err == nil {
+				entry.SerialNo = sn
+			}
+		}
+
+		if c.json {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(line))
+		} else {
+			fmt.Printf("%3d  %-12s  %s:%s  %-14s  %-7s  %s\n",
+				entry.Bus, entry.Location, entry.VendorId, entry.ProductId, entry.Chip, entry.Mode, entry.SerialNo)
+		}
+	}
+	return nil
+}
+
+func (c *cli) info() error {
+	return c.forEachDevice(true, func(name string, rkDev *rkusb.RkDevice) error {
+		if c.json {
+			report, err := json.Marshal(rkDev.Report())
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(report))
+			return nil
+		}
+
+		// the flash info counts the logical space in units of 512 kB
+		flashInfo := rkDev.FlashInfo()
+		fmt.Println("Found device")
+		fmt.Printf("Chip: %s\n", rkDev.ChipInfo())
+		fmt.Printf("Flash: %s %d MB\n", flashInfo.Manufacturer, flashInfo.FlashSize/2)
+		fmt.Printf("  SN: %s\n", rkDev.GetSerialNo())
+		fmt.Printf(" UID: %s\n", rkDev.GetUID())
+		fmt.Printf("IMEI: %s\n", rkDev.GetIMEI())
+		fmt.Printf(" MAC: %s\n", rkDev.GetMacAddress())
+		fmt.Printf("  BT: %s\n", rkDev.GetBtAddress())
+		fmt.Println()
+		return nil
+	})
+}
+
+func (c *cli) loaderInfo(file *os.File) error {
+	loader, err := rkusb.OpenLoader(file)
+	if err != nil {
+		return err
+	}
+	printLoader(loader)
+	return nil
+}
+
+func (c *cli) downloadBoot(file *os.File) error {
+	loader, err := rkusb.OpenLoader(file)
+	if err != nil {
+		return err
+	}
+	return c.forEachDevice(false, func(name string, rkDev *rkusb.RkDevice) error {
+		if rkDev.Mode() != rkusb.ModeMaskrom {
+			fmt.Fprintf(c.status, "%s: Device is in %s mode, no boot loader needed\n", name, rkDev.Mode())
+			return nil
+		}
+		err := rkDev.DownloadBoot(loader)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: Boot loader downloaded\n", name)
+		return nil
+	})
+}
+
+func (c *cli) upgradeLoader(file *os.File) error {
+	loader, err := rkusb.OpenLoader(file)
+	if err != nil {
+		return err
+	}
+	return c.forEachDevice(true, func(name string, rkDev *rkusb.RkDevice) error {
+		err := rkDev.UpgradeLoader(loader)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: Loader upgraded\n", name)
+		return nil
+	})
+}
+
+func (c *cli) rebuildIdb(file *os.File) error {
+	loader, err := rkusb.OpenLoader(file)
+	if err != nil {
+		return err
+	}
+	return c.forEachDevice(false, func(name string, rkDev *rkusb.RkDevice) error {
+		err := rkDev.RebuildIdB(loader)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: IDB rebuilt\n", name)
+		return nil
+	})
+}
+
+func (c *cli) flash(file *os.File, filter rkusb.PartFilter, id identity, reset bool) error {
+	rkImage, err := rkusb.OpenImage(file)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.status, "md5 checksum: OK")
+
+	flashDevice := func(name string, rkDev *rkusb.RkDevice) error {
+		if id != (identity{}) {
+			err := rkDev.ReadDeviceData()
+			if err != nil {
+				return err
+			}
+			err = writeIdentity(rkDev, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		// a daemon would pile up progress bars, only the results are printed
+		var progress rkusb.ProgressFunc
+		if !c.watch {
+			progress = newProgressBars(name).update
+		}
+		err := rkDev.WriteImageParts(rkImage, filter, progress)
+		if errors.Is(err, rkusb.ErrNoParameter) || errors.Is(err, rkusb.ErrParameterChecksum) {
+			return fmt.Errorf("%w, flash the parameter of the image or pass --no-layout-check", err)
+		}
+		if err != nil {
+			return err
+		}
+		if reset {
+			return rkDev.ResetDevice()
+		}
+		return nil
+	}
+
+	if c.watch {
+		return c.watchDevices(false, flashDevice)
+	}
+
+	uiprogress.Start()
+	results, err := c.forEachDeviceParallel(false, flashDevice)
+	uiprogress.Stop()
+	if err != nil {
+		return err
+	}
+	return c.summary(results)
+}
+
+func (c *cli) setId(id identity) error {
+	if id == (identity{}) {
+		return errors.New("nothing to set")
+	}
+	return c.forEachDevice(true, func(name string, rkDev *rkusb.RkDevice) error {
+		err := writeIdentity(rkDev, id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: Identity of %s written\n", name, rkDev.GetSerialNo())
+		return nil
+	})
+}
+
+// writeIdentity sets the non empty fields of id and writes IDB sector 3.
+func writeIdentity(rkDev *rkusb.RkDevice, id identity) error {
+	if len(id.sn) > 0 {
+		err := rkDev.SetSerialNo(id.sn)
+		if err != nil {
+			return err
+		}
+	}
+	if len(id.imei) > 0 {
+		err := rkDev.SetImei(id.imei)
+		if err != nil {
+			return err
+		}
+	}
+	if len(id.uid) > 0 {
+		err := rkDev.SetUid(id.uid)
+		if err != nil {
+			return err
+		}
+	}
+	if len(id.mac) > 0 {
+		err := rkDev.SetMacAddr(id.mac)
+		if err != nil {
+			return err
+		}
+	}
+	if len(id.bt) > 0 {
+		err := rkDev.SetBtAddr(id.bt)
+		if err != nil {
+			return err
+		}
+	}
+	return rkDev.WriteDeviceData()
+}
+
+func (c *cli) readLba(start string, count string, file *os.File, reserved bool) error {
+	first, err := parseNumber(start)
+	if err != nil {
+		return err
+	}
+	sectors, err := parseNumber(count)
+	if err != nil {
+		return err
+	}
+	return c.forOneDevice(false, func(name string, rkDev *rkusb.RkDevice) error {
+		uiprogress.Start()
+		err := rkDev.ReadLba(first, sectors, file, reservedFlag(reserved), newProgressBars(name).update)
+		uiprogress.Stop()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: Read %d sectors at 0x%08X to %s\n", name, sectors, first, file.Name())
+		return nil
+	})
+}
+
+func (c *cli) writeLba(start string, file *os.File, reserved bool) error {
+	first, err := parseNumber(start)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return c.forEachDevice(false, func(name string, rkDev *rkusb.RkDevice) error {
+		_, err := file.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+		uiprogress.Start()
+		err = rkDev.WriteLba(first, file, info.Size(), reservedFlag(reserved), newProgressBars(name).update)
+		uiprogress.Stop()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: Wrote %s at 0x%08X\n", name, file.Name(), first)
+		return nil
+	})
+}
+
+// reservedFlag converts the --reserved flag into the reserved byte of the LBA
+// commands.
+func reservedFlag(reserved bool) byte {
+	if reserved {
+		return 1
+	}
+	return 0
+}
+
+func (c *cli) erase(block string, count string) error {
+	first, err := parseNumber(block)
+	if err != nil {
+		return err
+	}
+	blocks, err := parseNumber(count)
+	if err != nil {
+		return err
+	}
+	return c.forEachDevice(true, func(name string, rkDev *rkusb.RkDevice) error {
+		err := rkDev.EraseBlocks(uint(first), uint(blocks))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: Erased %d blocks\n", name, blocks)
+		return nil
+	})
+}
+
+func (c *cli) dumpIdb(file *os.File) error {
+	return c.forOneDevice(true, func(name string, rkDev *rkusb.RkDevice) error {
+		err := rkDev.DumpIdB(file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: IDB dumped to %s\n", name, file.Name())
+		return nil
+	})
+}
+
+func (c *cli) restoreIdb(file *os.File) error {
+	return c.forOneDevice(true, func(name string, rkDev *rkusb.RkDevice) error {
+		err := rkDev.RestoreIdB(file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: IDB restored\n", name)
+		return nil
+	})
+}
+
+func (c *cli) parameter(file *os.File) error {
+	if file != nil {
+		rkImage, err := rkusb.OpenImage(file)
+		if err != nil {
+			return err
+		}
+		p, err := rkImage.Parameter()
+		if err != nil {
+			return err
+		}
+		return c.printParameter(p)
+	}
+
+	return c.forOneDevice(false, func(name string, rkDev *rkusb.RkDevice) error {
+		p, err := rkDev.ReadParameter()
+		if err != nil {
+			return err
+		}
+		return c.printParameter(p)
+	})
+}
+
+func (c *cli) printParameter(p *rkusb.Parameter) error {
+	if c.json {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	fmt.Printf("Firmware version: %s\n", p.FirmwareVer)
+	fmt.Printf("Machine model:    %s\n", p.MachineModel)
+	fmt.Printf("Machine id:       %s\n", p.MachineId)
+	fmt.Printf("Manufacturer:     %s\n", p.Manufacturer)
+	fmt.Printf("Magic:            0x%08X\n", p.Magic)
+	fmt.Printf("Atag:             0x%08X\n", p.Atag)
+	fmt.Printf("Machine:          %d\n", p.Machine)
+	fmt.Printf("Check mask:       0x%02X\n", p.CheckMask)
+	fmt.Printf("Kernel image:     0x%08X\n", p.KernelImg)
+	fmt.Printf("Mtd id:           %s\n", p.MtdId)
+	fmt.Println()
+	fmt.Printf("%-16s  %-10s  %-10s  %s\n", "NAME", "OFFSET", "SIZE", "SIZE MB")
+	for _, part := range p.Partitions {
+		if part.Grow {
+			fmt.Printf("%-16s  0x%08X  %-10s  %s\n", part.Name, part.Offset, "-", "-")
+		} else {
+			fmt.Printf("%-16s  0x%08X  0x%08X  %d\n", part.Name, part.Offset, part.Size, part.Size/2048)
+		}
+	}
+	return nil
+}
+
+// buildParameter writes a PARM blob built from the parameter in from, the
+// partition list and the header fields that are not empty.
+func (c *cli) buildParameter(file *os.File, from *os.File, partitions string, header map[string]string) error {
+	p := &rkusb.Parameter{}
+	if from != nil {
+		data, err := ioutil.ReadAll(from)
+		if err != nil {
+			return err
+		}
+		p, err = rkusb.ParseParameter(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := applyHeader(p, header)
+	if err != nil {
+		return err
+	}
+
+	if partitions != "" {
+		parts, err := parsePartitionList(partitions)
+		if err != nil {
+			return err
+		}
+		// keep the flags, e.g. bootable, of the partitions in from, grow only
+		// while the partition still grows
+		for i := range parts {
+			old, ok := p.Partition(parts[i].Name)
+			if !ok {
+				continue
+			}
+			for _, flag := range old.Flags {
+				if flag != "grow" || parts[i].Grow {
+					parts[i].Flags = append(parts[i].Flags, flag)
+				}
+			}
+		}
+		p.Partitions = parts
+	}
+	if len(p.Partitions) == 0 {
+		return errors.New("no partitions given")
+	}
+
+	data, err := p.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.status, "Parameter with %d partitions written to %s\n", len(p.Partitions), file.Name())
+	return nil
+}
+
+// applyHeader sets the header fields given on the command line, keyed by
+// their name in the parameter file.
+func applyHeader(p *rkusb.Parameter, header map[string]string) error {
+	numbers := map[string]*uint32{
+		"MAGIC":      &p.Magic,
+		"ATAG":       &p.Atag,
+		"MACHINE":    &p.Machine,
+		"CHECK_MASK": &p.CheckMask,
+		"KERNEL_IMG": &p.KernelImg,
+	}
+	texts := map[string]*string{
+		"FIRMWARE_VER":  &p.FirmwareVer,
+		"MACHINE_MODEL": &p.MachineModel,
+		"MACHINE_ID":    &p.MachineId,
+		"MANUFACTURER":  &p.Manufacturer,
+		"CMDLINE":       &p.CmdLine,
+	}
+	for key, value := range header {
+		if value == "" {
+			continue
+		}
+		if field, ok := texts[key]; ok {
+			*field = value
+			continue
+		}
+		n, err := parseNumber(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		*numbers[key] = n
+	}
+	return nil
+}
+
+// parsePartitionList parses name=size[@offset],... where size - grows to the
+// end of the flash, a partition without offset follows the one before.
+func parsePartitionList(list string) ([]rkusb.Partition, error) {
+	var parts []rkusb.Partition
+	var next uint32
+	for _, entry := range splitNames(list) {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid partition %s, expected name=size[@offset]", entry)
+		}
+		part := rkusb.Partition{Name: entry[:i], Offset: next}
+		size := entry[i+1:]
+		if j := strings.Index(size, "@"); j >= 0 {
+			offset, err := parseNumber(size[j+1:])
+			if err != nil {
+				return nil, err
+			}
+			part.Offset = offset
+			size = size[:j]
+		}
+		if size == "-" {
+			part.Grow = true
+		} else {
+			n, err := parseNumber(size)
+			if err != nil {
+				return nil, err
+			}
+			part.Size = n
+		}
+		parts = append(parts, part)
+		next = part.Offset + part.Size
+	}
+	return parts, nil
+}
+
+func (c *cli) writeParameter(file *os.File) error {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	p, err := rkusb.ParseParameter(data)
+	if err != nil {
+		return err
+	}
+	// a text file is encoded, a PARM blob is written as it is
+	if len(data) < 4 || binary.LittleEndian.Uint32(data) != rkusb.ParameterTag {
+		data, err = p.Encode()
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.forEachDevice(false, func(name string, rkDev *rkusb.RkDevice) error {
+		uiprogress.Start()
+		err := rkDev.WriteParameterBlob(data, newProgressBars(name).update)
+		uiprogress.Stop()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: Parameter written\n", name)
+		return nil
+	})
+}
+
+func (c *cli) gpt() error {
+	return c.forOneDevice(true, func(name string, rkDev *rkusb.RkDevice) error {
+		g, err := rkDev.ReadGpt()
+		if err != nil {
+			return err
+		}
+		return c.printGpt(g)
+	})
+}
+
+func (c *cli) writeGpt(file *os.File, force bool) error {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	p, err := rkusb.ParseParameter(data)
+	if err != nil {
+		return err
+	}
+	if len(p.Partitions) == 0 {
+		return fmt.Errorf("%s has no partitions", file.Name())
+	}
+
+	return c.forEachDevice(true, func(name string, rkDev *rkusb.RkDevice) error {
+		// the protective MBR replaces the PARM copy at LBA 0 the loaders of
+		// older SoCs boot from
+		if !force {
+			_, err := rkDev.ReadParameter()
+			if err == nil || errors.Is(err, rkusb.ErrParameterChecksum) {
+				return errors.New("the device holds a parameter at LBA 0 that the GPT would overwrite, use --force to write it anyway")
+			}
+			if !errors.Is(err, rkusb.ErrNoParameter) {
+				return err
+			}
+		}
+
+		g, err := rkusb.ParameterToGpt(p, uint64(rkDev.LogicalSectors()))
+		if err != nil {
+			return err
+		}
+		err = rkDev.WriteGpt(g)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: GPT with %d partitions written\n", name, len(g.Partitions))
+		return c.printGpt(g)
+	})
+}
+
+func (c *cli) printGpt(g *rkusb.Gpt) error {
+	if c.json {
+		data, err := json.Marshal(g)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	fmt.Printf("Disk GUID:   %s\n", g.DiskGuid)
+	fmt.Printf("Usable LBAs: 0x%08X-0x%08X\n", g.FirstUsableLba, g.LastUsableLba)
+	fmt.Println()
+	fmt.Printf("%-16s  %-10s  %-10s  %-8s  %s\n", "NAME", "FIRST", "LAST", "SIZE MB", "GUID")
+	for _, part := range g.Partitions {
+		fmt.Printf("%-16s  0x%08X  0x%08X  %-8d  %s\n",
+			part.Name, part.FirstLba, part.LastLba, (part.LastLba-part.FirstLba+1)/2048, part.UniqueGuid)
+	}
+	return nil
+}
+
+func (c *cli) backup(file *os.File) error {
+	return c.forOneDevice(true, func(name string, rkDev *rkusb.RkDevice) error {
+		idbFile, err := os.OpenFile(file.Name()+".idb", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer idbFile.Close()
+
+		uiprogress.Start()
+		info, err := rkDev.Backup(file, idbFile, newProgressBars(name).update)
+		uiprogress.Stop()
+		if err != nil {
+			return err
+		}
+		info.Image = filepath.Base(file.Name())
+		info.IdbDump = filepath.Base(idbFile.Name())
+
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(file.Name()+".json", data, 0600)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: Backed up %d sectors to %s\n", name, info.Sectors, file.Name())
+		return nil
+	})
+}
+
+func (c *cli) restore(file *os.File) error {
+	data, err := ioutil.ReadFile(file.Name() + ".json")
+	if err != nil {
+		return err
+	}
+	var info rkusb.BackupInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return fmt.Errorf("invalid backup description %s.json: %w", file.Name(), err)
+	}
+
+	return c.forEachDevice(true, func(name string, rkDev *rkusb.RkDevice) error {
+		_, err := file.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+		uiprogress.Start()
+		err = rkDev.Restore(info, file, newProgressBars(name).update)
+		uiprogress.Stop()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.status, "%s: Restored %d sectors from %s\n", name, info.Sectors, file.Name())
+		return nil
+	})
+}
+
+// unpackLoader is the name the loader of the RKFW header is extracted to.
+const unpackLoader = "boot.bin"
+
+type unpackReport struct {
+	Version      string         `json:"version"`
+	Date         string         `json:"date"`
+	Code         string         `json:"code"`
+	Chip         string         `json:"chip"`
+	MachineModel string         `json:"machine_model"`
+	Manufacturer string         `json:"manufacturer"`
+	LoaderOffset uint32         `json:"loader_offset"`
+	LoaderSize   uint32         `json:"loader_size"`
+	FwOffset     uint32         `json:"fw_offset"`
+	FwSize       uint32         `json:"fw_size"`
+	Parts        []unpackedPart `json:"parts"`
+}
+
+type unpackedPart struct {
+	Name     string `json:"name"`
+	File     string `json:"file"`
+	NandAddr uint32 `json:"nand_addr"`
+	Size     uint32 `json:"size"`
+	Written  bool   `json:"written"`
+}
+
+func (c *cli) unpack(file *os.File, dir string) error {
+	rkImage, err := rkusb.OpenImage(file)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	h := rkImage.FwHeader
+	report := unpackReport{
+		Version:      h.VersionString(),
+		Date:         h.Date(),
+		Code:         fmt.Sprintf("0x%08X", h.Code),
+		Chip:         fmt.Sprintf("0x%08X", h.Chip),
+		MachineModel: cString(rkImage.ImageHeader.MachineModel[:]),
+		Manufacturer: cString(rkImage.ImageHeader.Manufacturer[:]),
+		LoaderOffset: h.LoaderOffset,
+		LoaderSize:   h.LoaderSize,
+		FwOffset:     h.FwOffset,
+		FwSize:       h.FwSize,
+	}
+
+	manifest := false
+	for _, part := range rkImage.ImageParts {
+		entry := unpackedPart{Name: part.Name, File: part.File, NandAddr: part.NandAddr, Size: part.Size}
+		if part.HasData() {
+			err = extractTo(dir, part.File, func(w io.Writer) error {
+				return rkImage.ExtractPart(part, w)
+			})
+			if err != nil {
+				return err
+			}
+			entry.Written = true
+			manifest = manifest || part.File == "package-file"
+		}
+		report.Parts = append(report.Parts, entry)
+	}
+
+	// images built by afptool carry the manifest as a part
+	if !manifest {
+		err = ioutil.WriteFile(filepath.Join(dir, "package-file"), []byte(rkImage.PackageFile()), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if h.LoaderSize > 0 {
+		err = extractTo(dir, unpackLoader, rkImage.ExtractLoader)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.json {
+		data, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	fmt.Printf("Version:      %s\n", report.Version)
+	fmt.Printf("Date:         %s\n", report.Date)
+	fmt.Printf("Code:         %s\n", report.Code)
+	fmt.Printf("Chip:         %s\n", report.Chip)
+	fmt.Printf("Model:        %s\n", report.MachineModel)
+	fmt.Printf("Manufacturer: %s\n", report.Manufacturer)
+	if h.LoaderSize > 0 {
+		fmt.Printf("Loader:       %d bytes at 0x%08X -> %s\n", h.LoaderSize, h.LoaderOffset, unpackLoader)
+	} else {
+		fmt.Println("Loader:       none")
+	}
+	fmt.Printf("Firmware:     %d bytes at 0x%08X\n", h.FwSize, h.FwOffset)
+	fmt.Println()
+	fmt.Printf("%-16s  %-32s  %-10s  %10s\n", "NAME", "FILE", "NAND ADDR", "SIZE")
+	for _, part := range report.Parts {
+		size := fmt.Sprintf("%d", part.Size)
+		if !part.Written {
+			size = "-"
+		}
+		fmt.Printf("%-16s  %-32s  0x%08X  %10s\n", part.Name, part.File, part.NandAddr, size)
+	}
+	return nil
+}
+
+// extractTo creates the file at the relative path below dir, including its
+// directories, and lets extract write it. Paths leaving dir are refused.
+func extractTo(dir string, path string, extract func(w io.Writer) error) error {
+	target, err := rkusb.UnpackPath(dir, path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = extract(f)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// cString returns a zero terminated string of a fixed size field.
+func cString(field []byte) string {
+	i := bytes.IndexByte(field, 0)
+	if i >= 0 {
+		field = field[:i]
+	}
+	return string(field)
+}
+
+func (c *cli) reset() error {
+	return c.forEachDevice(false, func(name string, rkDev *rkusb.RkDevice) error {
+		return rkDev.ResetDevice()
+	})
+}
+
+// splitNames splits a comma separated list of names, empty entries are
+// dropped.
+func splitNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseNumber parses a decimal or 0x prefixed hexadecimal number.
+func parseNumber(s string) (uint32, error) {
+	n, err := rkusb.ParseNumber(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %s", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint32
+		ok   bool
+	}{
+		{"16", 16, true},
+		{"0x10", 0x10, true},
+		{"0X1f", 0x1F, true},
+		{"010", 10, true},
+		{"0xFFFFFFFF", 0xFFFFFFFF, true},
+		{"0o17", 0, false},
+		{"0b101", 0, false},
+		{"1_000", 0, false},
+		{"0x", 0, false},
+		{"-1", 0, false},
+		{"0x100000000", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseNumber(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %d, want %d", test.in, got, test.want)
+		}
+	}
+}
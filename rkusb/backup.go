@@ -0,0 +1,110 @@
+package rkusb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BackupSchemaVersion is increased whenever a field of BackupInfo changes
+// its meaning or is removed.
+const BackupSchemaVersion = 1
+
+// BackupInfo describes a backup of the logical space of a device. It is
+// written next to the image so a restore can check it is done on a matching
+// device.
+type BackupInfo struct {
+	SchemaVersion int             `json:"schema_version"`
+	ChipInfo      string          `json:"chip_info"`
+	FlashInfo     FlashInfoReport `json:"flash_info"`
+	IdBlocks      []uint          `json:"id_blocks"`
+	Sectors       uint32          `json:"sectors"`
+	Image         string          `json:"image"`
+	IdbDump       string          `json:"idb_dump"`
+}
+
+// LogicalSectors returns the number of 512 byte sectors of the logical space
+// reported by the flash info. ReadDeviceData has to be called before.
+func (rkDev *RkDevice) LogicalSectors() uint32 {
+	return uint32(rkDev.flashInfo.FlashSize * 1024)
+}
+
+// Backup reads the whole logical space to image and the raw ID blocks to idb
+// and returns the description of the backup, the file names are left to the
+// caller. ReadDeviceData has to be called before.
+func (rkDev *RkDevice) Backup(image io.Writer, idb io.Writer, progress ProgressFunc) (BackupInfo, error) {
+	sectors := rkDev.LogicalSectors()
+	if sectors == 0 {
+		return BackupInfo{}, errors.New("backup: flash info reports no logical space")
+	}
+
+	err := rkDev.DumpIdB(idb)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	err = rkDev.ReadLba(0, sectors, image, 0, progress)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	report := rkDev.Report()
+	return BackupInfo{
+		SchemaVersion: BackupSchemaVersion,
+		ChipInfo:      report.ChipInfo,
+		FlashInfo:     report.FlashInfo,
+		IdBlocks:      report.IdBlocks,
+		Sectors:       sectors,
+	}, nil
+}
+
+// Restore writes a backup created by Backup back to the logical space, every
+// chunk is read back and compared. The ID blocks are not touched, they are
+// restored with RestoreIdB. ReadDeviceData has to be called before.
+func (rkDev *RkDevice) Restore(info BackupInfo, image io.Reader, progress ProgressFunc) error {
+	if info.SchemaVersion != BackupSchemaVersion {
+		return fmt.Errorf("unsupported backup version %d", info.SchemaVersion)
+	}
+	chipInfo := bytesToString([]byte(rkDev.chipInfo))
+	if info.ChipInfo != chipInfo {
+		return fmt.Errorf("backup was taken from chip %s, the device is %s", info.ChipInfo, chipInfo)
+	}
+	if info.Sectors != rkDev.LogicalSectors() {
+		return fmt.Errorf("backup holds %d sectors, the device has %d", info.Sectors, rkDev.LogicalSectors())
+	}
+
+	err := rkDev.initDeviceAsync()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, lbaChunk*512)
+	for done := uint32(0); done < info.Sectors; {
+		length := info.Sectors - done
+		if length > lbaChunk {
+			length = lbaChunk
+		}
+		data := buf[0 : length*512]
+		_, err = io.ReadFull(image, data)
+		if err != nil {
+			return fmt.Errorf("reading backup at lba 0x%08X: %w", done, err)
+		}
+
+		err = rkDev.writeLba(done, data, 0)
+		if err != nil {
+			return err
+		}
+		r, err := rkDev.readLba(done, uint(len(data)), 0)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(r, data) {
+			return &ErrVerifyMismatch{"backup", done}
+		}
+
+		done += length
+		reportProgress(progress, "restore", "lba", int(done), int(info.Sectors))
+	}
+	return nil
+}
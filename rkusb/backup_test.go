@@ -0,0 +1,73 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	config := emulator.DefaultConfig()
+	config.FlashSize = 0x4000
+	emu, dev := newTestDevice(t, config)
+
+	first := bytes.Repeat([]byte{0xA5}, 3*512)
+	last := bytes.Repeat([]byte{0x5A}, 512)
+	emu.WriteLba(0x100, first)
+	emu.WriteLba(0x3FFF, last)
+
+	var image, idb bytes.Buffer
+	info, err := dev.Backup(&image, &idb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ChipInfo != "A213" || info.Sectors != 0x4000 {
+		t.Errorf("chip %q, sectors 0x%X, want A213 and 0x4000", info.ChipInfo, info.Sectors)
+	}
+	if image.Len() != 0x4000*512 {
+		t.Errorf("image of %d bytes, want %d", image.Len(), 0x4000*512)
+	}
+	if idb.Len() == 0 {
+		t.Error("no IDB dumped")
+	}
+
+	// the sidecar is stored as JSON
+	sidecar, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored rkusb.BackupInfo
+	err = json.Unmarshal(sidecar, &restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emu.WriteLba(0x100, make([]byte, 3*512))
+	emu.WriteLba(0x3FFF, make([]byte, 512))
+
+	wrongChip := restored
+	wrongChip.ChipInfo = "B000"
+	err = dev.Restore(wrongChip, bytes.NewReader(image.Bytes()), nil)
+	if err == nil {
+		t.Error("restore of a backup of another chip succeeded")
+	}
+	wrongSize := restored
+	wrongSize.Sectors = 0x8000
+	err = dev.Restore(wrongSize, bytes.NewReader(image.Bytes()), nil)
+	if err == nil {
+		t.Error("restore of a backup of another flash size succeeded")
+	}
+	if !bytes.Equal(emu.ReadLba(0x100, 3), make([]byte, 3*512)) {
+		t.Fatal("refused restore wrote data")
+	}
+
+	err = dev.Restore(restored, bytes.NewReader(image.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(emu.ReadLba(0x100, 3), first) || !bytes.Equal(emu.ReadLba(0x3FFF, 1), last) {
+		t.Error("data differs after the restore")
+	}
+}
@@ -1,8 +1,9 @@
-package main
+package rkusb
 
 import "math"
 
 const Crc16Ccitt = 0x1021
+const Crc32Rk = 0x04C10DB7
 
 const rrMax = 104
 const mm = 13
@@ -77,6 +78,18 @@ func crc16(buf []byte, len uint16) uint16 {
 	return accum
 }
 
+// CrcCcitt is the CRC-CCITT (polynomial 0x1021, initial value 0xFFFF) that
+// terminates the data sent to a device in Maskrom mode.
+func CrcCcitt(buf []byte) uint16 {
+	var accum uint16 = 0xFFFF
+	crcTable := crcBuildTable16(Crc16Ccitt)
+	for i := 0; i < len(buf); i++ {
+		accum = (accum << 8) ^ crcTable[(accum>>8)^uint16(buf[i])]
+	}
+
+	return accum
+}
+
 func crcBuildTable16(aPoly uint16) []uint16 {
 	var i uint16
 	var j uint16
@@ -101,6 +114,42 @@ func crcBuildTable16(aPoly uint16) []uint16 {
 	return crcTable
 }
 
+// rkCrc32 is the CRC32 Rockchip appends to loader and parameter files. It is
+// not reflected, starts with 0 and uses the polynomial 0x04C10DB7.
+func rkCrc32(buf []byte) uint32 {
+	var accum uint32 = 0
+	crcTable := crcBuildTable32(Crc32Rk)
+	for i := 0; i < len(buf); i++ {
+		accum = (accum << 8) ^ crcTable[(accum>>24)^uint32(buf[i])]
+	}
+
+	return accum
+}
+
+func crcBuildTable32(aPoly uint32) []uint32 {
+	var i uint32
+	var j uint32
+	var data uint32
+	var accum uint32
+	crcTable := make([]uint32, 256)
+
+	for i = 0; i < 256; i++ {
+		data = i << 24
+		accum = 0
+		for j = 0; j < 8; j++ {
+			if ((data ^ accum) & 0x80000000) != 0 {
+				accum = (accum << 1) ^ aPoly
+			} else {
+				accum <<= 1
+			}
+
+			data <<= 1
+		}
+		crcTable[i] = accum
+	}
+	return crcTable
+}
+
 func generateGf() {
 	var i uint32
 	var mask uint32 // Register states
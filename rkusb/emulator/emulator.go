@@ -0,0 +1,399 @@
+// Package emulator implements a software Rockchip device. In loader mode it
+// answers the CBW commands RkDevice sends through its rkusb.Transport and keeps
+// the device storage in memory: a simulated raw NAND with 528 byte sectors for
+// the sector commands and a separate logical block space for the LBA commands.
+// In Maskrom mode it only accepts the 471 and 472 boot downloads and switches
+// to loader mode once the 472 entry arrived.
+package emulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"rockchipr/rkusb"
+	"sync"
+	"time"
+)
+
+const cbwLength = 31
+const cswLength = 13
+const lbaSectorSize = 512
+
+var errNoData = errors.New("no data available")
+
+type Config struct {
+	ChipInfo []byte
+	// FlashSize is the size of the flash in sectors of 512 bytes.
+	FlashSize uint32
+	// BlockSize is the number of sectors per block.
+	BlockSize uint16
+	// PageSize is the number of sectors per page.
+	PageSize   byte
+	EccBits    byte
+	AccessTime byte
+	ManufCode  byte
+	FlashCS    byte
+	BadBlocks  []uint32
+	// Maskrom starts the device in Maskrom mode instead of loader mode.
+	Maskrom bool
+}
+
+// DefaultConfig describes a RK3128 with 8 GB NAND, 256 kB blocks and 4 kB pages.
+func DefaultConfig() Config {
+	return Config{
+		ChipInfo:   []byte("A213"),
+		FlashSize:  0x1000000,
+		BlockSize:  0x200,
+		PageSize:   8,
+		EccBits:    40,
+		AccessTime: 40,
+		ManufCode:  0,
+		FlashCS:    1,
+	}
+}
+
+type command struct {
+	tag      uint32
+	opCode   byte
+	address  uint32
+	length   uint16
+	reserved byte
+	data     []byte
+	expected int
+}
+
+// Emulator is a rkusb.Transport that behaves like a device running the
+// Rockchip loader.
+type Emulator struct {
+	mutex   sync.Mutex
+	config  Config
+	nand    *Nand
+	lba     map[uint32][]byte
+	in      [][]byte
+	pending *command
+	resets  int
+	closed  bool
+	maskrom bool
+	// boot data received with control transfers, by request index
+	download   map[uint16][]byte
+	downloaded map[uint16][][]byte
+}
+
+func New(config Config) *Emulator {
+	blocks := config.FlashSize / uint32(config.BlockSize)
+	return &Emulator{
+		config:     config,
+		nand:       NewNand(blocks, uint32(config.BlockSize), config.BadBlocks),
+		lba:        map[uint32][]byte{},
+		maskrom:    config.Maskrom,
+		download:   map[uint16][]byte{},
+		downloaded: map[uint16][][]byte{},
+	}
+}
+
+// Mode implements rkusb.ModeReporter, the emulator is in Maskrom mode until
+// a boot loader was downloaded.
+func (e *Emulator) Mode() rkusb.UsbMode {
+	if e.InMaskrom() {
+		return rkusb.ModeMaskrom
+	}
+	return rkusb.ModeLoader
+}
+
+// InMaskrom reports whether the device still waits for a boot download.
+func (e *Emulator) InMaskrom() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.maskrom
+}
+
+// Downloaded returns the entries received for the 0x471 or 0x472 request,
+// without the trailing CRC.
+func (e *Emulator) Downloaded(code uint16) [][]byte {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([][]byte(nil), e.downloaded[code]...)
+}
+
+func (e *Emulator) Nand() *Nand {
+	return e.nand
+}
+
+// Resets returns how often the device received a DeviceReset command.
+func (e *Emulator) Resets() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.resets
+}
+
+// WriteIdBlock erases block and programs data, a multiple of 528 byte sectors,
+// to its start. It is used to provision the ID blocks before a test.
+func (e *Emulator) WriteIdBlock(block uint32, data []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	err := e.nand.Erase(block, 1)
+	if err != nil {
+		return err
+	}
+	return e.nand.Program(block*uint32(e.config.BlockSize), data)
+}
+
+// ReadLba returns count logical sectors starting at lba.
+func (e *Emulator) ReadLba(lba uint32, count uint32) []byte {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	data, _ := e.readLba(lba, count)
+	return data
+}
+
+// WriteLba stores data, padded to whole sectors, at lba.
+func (e *Emulator) WriteLba(lba uint32, data []byte) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if len(data)%lbaSectorSize != 0 {
+		data = append(data, make([]byte, lbaSectorSize-len(data)%lbaSectorSize)...)
+	}
+	_ = e.writeLba(lba, data)
+}
+
+func (e *Emulator) BulkOut(data []byte, timeout time.Duration) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return 0, errors.New("emulator closed")
+	}
+
+	if e.maskrom {
+		// the Maskrom code does not answer CBWs
+		return len(data), nil
+	}
+
+	if e.pending != nil {
+		e.pending.data = append(e.pending.data, data...)
+		if len(e.pending.data) >= e.pending.expected {
+			cmd := e.pending
+			e.pending = nil
+			e.execute(cmd)
+		}
+		return len(data), nil
+	}
+
+	cmd, err := parseCbw(data)
+	if err != nil {
+		return 0, err
+	}
+
+	switch cmd.opCode {
+	case rkusb.WriteSector:
+		cmd.expected = int(cmd.length) * rkusb.PhysicalSectorSize
+	case rkusb.WriteLba:
+		cmd.expected = int(cmd.length) * lbaSectorSize
+	}
+
+	if cmd.expected > 0 {
+		e.pending = cmd
+	} else {
+		e.execute(cmd)
+	}
+	return len(data), nil
+}
+
+func (e *Emulator) BulkIn(maxLength int, timeout time.Duration) ([]byte, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil, errors.New("emulator closed")
+	}
+	if len(e.in) == 0 {
+		return nil, errNoData
+	}
+	packet := e.in[0]
+	if len(packet) > maxLength {
+		e.in[0] = packet[maxLength:]
+		return packet[:maxLength], nil
+	}
+	e.in = e.in[1:]
+	return packet, nil
+}
+
+func (e *Emulator) Control(requestType byte, request byte, value uint16, index uint16, data []byte, timeout time.Duration) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return 0, errors.New("emulator closed")
+	}
+	if !e.maskrom {
+		return 0, errors.New("control transfers are not supported in loader mode")
+	}
+	if requestType != 0x40 || request != 0x0C || (index != 0x0471 && index != 0x0472) {
+		return 0, fmt.Errorf("unsupported control request 0x%02X/0x%02X/0x%04X", requestType, request, index)
+	}
+
+	const maxTransfer = 4096
+	buffered := e.download[index]
+	if len(data) == maxTransfer {
+		e.download[index] = append(buffered, data...)
+		return len(data), nil
+	}
+
+	// a short transfer ends the entry, a single byte after a full transfer
+	// is only sent to terminate it
+	if len(data) != 1 || len(buffered) == 0 || len(buffered)%maxTransfer != 0 {
+		buffered = append(buffered, data...)
+	}
+	delete(e.download, index)
+
+	if len(buffered) < 2 {
+		return 0, errors.New("boot entry too short")
+	}
+	payload := buffered[:len(buffered)-2]
+	crc := uint16(buffered[len(buffered)-2])<<8 | uint16(buffered[len(buffered)-1])
+	if rkusb.CrcCcitt(payload) != crc {
+		return 0, errors.New("boot entry crc mismatch")
+	}
+	e.downloaded[index] = append(e.downloaded[index], payload)
+
+	if index == 0x0472 {
+		e.maskrom = false
+	}
+	return len(data), nil
+}
+
+func (e *Emulator) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.closed = true
+	return nil
+}
+
+func parseCbw(data []byte) (*command, error) {
+	if len(data) != cbwLength {
+		return nil, fmt.Errorf("unexpected CBW length %d", len(data))
+	}
+	if binary.BigEndian.Uint32(data[0:4]) != rkusb.CbwSign {
+		return nil, errors.New("invalid CBW signature")
+	}
+	return &command{
+		tag:      binary.BigEndian.Uint32(data[4:8]),
+		opCode:   data[15],
+		reserved: data[16],
+		address:  binary.BigEndian.Uint32(data[17:21]),
+		length:   binary.BigEndian.Uint16(data[22:24]),
+	}, nil
+}
+
+func (e *Emulator) execute(cmd *command) {
+	data, err := e.handle(cmd)
+	if err == nil && len(data) > 0 {
+		e.in = append(e.in, data)
+	}
+
+	var status byte = 0
+	if err != nil {
+		status = 1
+	}
+
+	csw := make([]byte, cswLength)
+	binary.BigEndian.PutUint32(csw[0:4], rkusb.CswSign)
+	binary.BigEndian.PutUint32(csw[4:8], cmd.tag)
+	csw[12] = status
+	e.in = append(e.in, csw)
+}
+
+func (e *Emulator) handle(cmd *command) ([]byte, error) {
+	switch cmd.opCode {
+	case rkusb.TestUnitReady:
+		return nil, nil
+	case rkusb.ReadFlashInfo:
+		return e.flashInfo(), nil
+	case rkusb.ReadChipInfo:
+		info := make([]byte, rkusb.ChipInfoLen)
+		copy(info, e.config.ChipInfo)
+		return info, nil
+	case rkusb.TestBadBlock:
+		return e.badBlockMap(), nil
+	case rkusb.ReadSector:
+		sector, err := physicalSector(cmd.address)
+		if err != nil {
+			return nil, err
+		}
+		return e.nand.Read(sector, uint32(cmd.length))
+	case rkusb.WriteSector:
+		sector, err := physicalSector(cmd.address)
+		if err != nil {
+			return nil, err
+		}
+		return nil, e.nand.Program(sector, cmd.data[:cmd.expected])
+	case rkusb.EraseNormal:
+		return nil, e.nand.Erase(cmd.address, uint32(cmd.length))
+	case rkusb.ReadLba:
+		return e.readLba(cmd.address, uint32(cmd.length))
+	case rkusb.WriteLba:
+		return nil, e.writeLba(cmd.address, cmd.data[:cmd.expected])
+	case rkusb.DeviceReset:
+		e.resets++
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported command 0x%02X", cmd.opCode)
+}
+
+// physicalSector converts the row address of the sector commands, the sector
+// number shifted by 8, back to the sector number. The low byte must be zero.
+func physicalSector(address uint32) (uint32, error) {
+	if address&0xff != 0 {
+		return 0, fmt.Errorf("invalid sector address 0x%X", address)
+	}
+	return address >> 8, nil
+}
+
+func (e *Emulator) flashInfo() []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, rkusb.FlashInfoCmd{
+		FlashSize:  e.config.FlashSize,
+		BlockSize:  e.config.BlockSize,
+		PageSize:   e.config.PageSize,
+		EccBits:    e.config.EccBits,
+		AccessTime: e.config.AccessTime,
+		ManufCode:  e.config.ManufCode,
+		FlashCS:    e.config.FlashCS,
+	})
+	info := make([]byte, 512)
+	copy(info, buf.Bytes())
+	return info
+}
+
+func (e *Emulator) badBlockMap() []byte {
+	bitmap := make([]byte, rkusb.MaxTestBlocks/8)
+	for block := uint32(0); block < rkusb.MaxTestBlocks; block++ {
+		if e.nand.IsBad(block) {
+			bitmap[block/8] |= 1 << (block % 8)
+		}
+	}
+	return bitmap
+}
+
+func (e *Emulator) readLba(lba uint32, count uint32) ([]byte, error) {
+	if uint64(lba)+uint64(count) > uint64(e.config.FlashSize) {
+		return nil, fmt.Errorf("lba 0x%X out of range", lba)
+	}
+	data := make([]byte, count*lbaSectorSize)
+	for i := uint32(0); i < count; i++ {
+		if sector, ok := e.lba[lba+i]; ok {
+			copy(data[i*lbaSectorSize:], sector)
+		}
+	}
+	return data, nil
+}
+
+func (e *Emulator) writeLba(lba uint32, data []byte) error {
+	count := uint32(len(data) / lbaSectorSize)
+	if uint64(lba)+uint64(count) > uint64(e.config.FlashSize) {
+		return fmt.Errorf("lba 0x%X out of range", lba)
+	}
+	for i := uint32(0); i < count; i++ {
+		start := i * lbaSectorSize
+		e.lba[lba+i] = append([]byte(nil), data[start:start+lbaSectorSize]...)
+	}
+	return nil
+}
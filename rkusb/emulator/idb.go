@@ -0,0 +1,46 @@
+package emulator
+
+import (
+	"rockchipr/rkusb"
+)
+
+// IdBlockData builds the content of an ID block that the IDB lookup of
+// RkDevice accepts: the four header sectors followed by dataSectors sectors of
+// boot data and codeSectors sectors of boot code, all of them zero filled.
+// idBlocks lists the blocks that hold a copy of the IDB and sec3 carries the
+// device identity.
+func IdBlockData(idBlocks []uint16, sec3 rkusb.RkAndroidIdBSec3, dataSectors uint16, codeSectors uint16) ([]byte, error) {
+	sec0 := rkusb.RkAndroidIdBSec0{
+		Tag:             0x0FF0AA55,
+		BootCode1Offset: 4,
+		BootCode2Offset: 4,
+		BootDataSize:    dataSectors,
+		BootCodeSize:    dataSectors + codeSectors,
+	}
+
+	sec1 := rkusb.RkAndroidIdBSec1{
+		SysReservedBlock: 0xC,
+		Disk0Size:        0xFFFF,
+		ChipTag:          0x38324B52,
+		LoaderYear:       0x2020,
+		LoaderDate:       0x0101,
+		LoaderVer:        0x0101,
+	}
+	blocks := []*uint16{&sec1.IdBlock0, &sec1.IdBlock1, &sec1.IdBlock2, &sec1.IdBlock3, &sec1.IdBlock4}
+	for i := 0; i < len(idBlocks) && i < len(blocks); i++ {
+		*blocks[i] = idBlocks[i]
+	}
+
+	sec2 := rkusb.RkAndroidIdBSec2{
+		VcTag:  [3]byte{'V', 'C', 0},
+		CrcTag: [4]byte{'C', 'R', 'C', 0},
+	}
+
+	header, err := rkusb.EncodeIdBSectors(sec0, sec1, sec2, sec3, [4][3]byte{})
+	if err != nil {
+		return nil, err
+	}
+
+	boot := make([]byte, int(dataSectors+codeSectors)*rkusb.PhysicalSectorSize)
+	return append(header, boot...), nil
+}
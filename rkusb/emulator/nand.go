@@ -0,0 +1,107 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"rockchipr/rkusb"
+)
+
+var errBadBlock = errors.New("bad block")
+
+// Nand simulates raw NAND flash with 528 byte sectors. Sectors that were never
+// programmed read as erased (0xFF). A sector can only be programmed once after
+// its block was erased and bad blocks can neither be erased nor programmed.
+type Nand struct {
+	sectorsPerBlock uint32
+	blocks          uint32
+	badBlocks       map[uint32]bool
+	sectors         map[uint32][]byte
+}
+
+func NewNand(blocks uint32, sectorsPerBlock uint32, badBlocks []uint32) *Nand {
+	nand := &Nand{
+		sectorsPerBlock: sectorsPerBlock,
+		blocks:          blocks,
+		badBlocks:       map[uint32]bool{},
+		sectors:         map[uint32][]byte{},
+	}
+	for _, block := range badBlocks {
+		nand.badBlocks[block] = true
+	}
+	return nand
+}
+
+func (nand *Nand) IsBad(block uint32) bool {
+	return nand.badBlocks[block]
+}
+
+func (nand *Nand) checkRange(sector uint32, count uint32) error {
+	if uint64(sector)+uint64(count) > uint64(nand.blocks)*uint64(nand.sectorsPerBlock) {
+		return fmt.Errorf("sector 0x%X out of range", sector)
+	}
+	for i := uint32(0); i < count; i++ {
+		if nand.IsBad((sector + i) / nand.sectorsPerBlock) {
+			return errBadBlock
+		}
+	}
+	return nil
+}
+
+// Read returns count physical sectors starting at sector.
+func (nand *Nand) Read(sector uint32, count uint32) ([]byte, error) {
+	err := nand.checkRange(sector, count)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, count*rkusb.PhysicalSectorSize)
+	for i := uint32(0); i < count; i++ {
+		data = append(data, nand.sector(sector+i)...)
+	}
+	return data, nil
+}
+
+// Program writes whole physical sectors starting at sector.
+func (nand *Nand) Program(sector uint32, data []byte) error {
+	if len(data)%rkusb.PhysicalSectorSize != 0 {
+		return errors.New("data is not a multiple of the sector size")
+	}
+	count := uint32(len(data) / rkusb.PhysicalSectorSize)
+	err := nand.checkRange(sector, count)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		if _, ok := nand.sectors[sector+i]; ok {
+			return fmt.Errorf("sector 0x%X programmed without erase", sector+i)
+		}
+	}
+	for i := uint32(0); i < count; i++ {
+		start := i * rkusb.PhysicalSectorSize
+		nand.sectors[sector+i] = append([]byte(nil), data[start:start+rkusb.PhysicalSectorSize]...)
+	}
+	return nil
+}
+
+// Erase erases count blocks starting at block.
+func (nand *Nand) Erase(block uint32, count uint32) error {
+	err := nand.checkRange(block*nand.sectorsPerBlock, count*nand.sectorsPerBlock)
+	if err != nil {
+		return err
+	}
+	first := block * nand.sectorsPerBlock
+	for i := uint32(0); i < count*nand.sectorsPerBlock; i++ {
+		delete(nand.sectors, first+i)
+	}
+	return nil
+}
+
+func (nand *Nand) sector(sector uint32) []byte {
+	data, ok := nand.sectors[sector]
+	if !ok {
+		data = make([]byte, rkusb.PhysicalSectorSize)
+		for i := range data {
+			data[i] = 0xFF
+		}
+	}
+	return data
+}
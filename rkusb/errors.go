@@ -0,0 +1,69 @@
+package rkusb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors returned by RkDevice, they are wrapped with the context they
+// occurred in and can be tested with errors.Is. Failed USB transfers are
+// reported as *TransferError, failed verifications as *ErrVerifyMismatch.
+var (
+	// ErrCswMismatch is returned when the CSW does not carry the signature
+	// or the tag of the command.
+	ErrCswMismatch = errors.New("csw does not match the command")
+	// ErrDeviceStatus is returned when the device reports a failed command
+	// in the CSW.
+	ErrDeviceStatus = errors.New("device reported a failed command")
+	// ErrNoIdBlock is returned when no valid ID block is found on the NAND.
+	ErrNoIdBlock = errors.New("no valid id block found")
+	// ErrInvalidIdentity is returned by the setters of the identity when a
+	// value does not fit into IDB sector 3.
+	ErrInvalidIdentity = errors.New("invalid identity value")
+	// ErrImageSignature is returned for update images without the RKFW or
+	// RKAF signature and for loaders that are neither BOOT nor LDR.
+	ErrImageSignature = errors.New("unexpected image signature")
+	// ErrImageChecksum is returned when the md5 of an update image or the
+	// CRC32 of a loader does not match the content.
+	ErrImageChecksum = errors.New("image checksum does not match")
+	// ErrParameterChecksum is returned when the CRC32 of a parameter file
+	// does not match its text.
+	ErrParameterChecksum = errors.New("parameter checksum does not match")
+	// ErrNoParameter is returned when the device holds no parameter at
+	// LBA 0.
+	ErrNoParameter = errors.New("no parameter found on the device")
+	// ErrNoGpt is returned when a sector does not hold a GPT header.
+	ErrNoGpt = errors.New("no gpt found")
+	// ErrGptChecksum is returned when the CRC32 of a GPT header or of its
+	// partition entries does not match.
+	ErrGptChecksum = errors.New("gpt checksum does not match")
+	// ErrMaskromMode is returned by commands that need a loader when the
+	// device is in Maskrom mode, DownloadBoot has to be called first.
+	ErrMaskromMode = errors.New("device is in maskrom mode, a loader has to be downloaded first")
+	// ErrMscMode is returned by loader commands when the device is in MSC
+	// mode.
+	ErrMscMode = errors.New("device is in msc mode and does not accept loader commands")
+)
+
+// ErrVerifyMismatch is returned when data read back from the device differs
+// from the data written. Partition is the name of the image part or IDB, LBA
+// the first sector of the failed transfer.
+type ErrVerifyMismatch struct {
+	Partition string
+	LBA       uint32
+}
+
+func (e *ErrVerifyMismatch) Error() string {
+	return fmt.Sprintf("verify of %s failed at 0x%08X", e.Partition, e.LBA)
+}
+
+// ErrLayoutMismatch is returned when the parts of an update image do not
+// match the partitions of the parameter, Problems lists every mismatch.
+type ErrLayoutMismatch struct {
+	Problems []string
+}
+
+func (e *ErrLayoutMismatch) Error() string {
+	return "image does not match the partition layout:\n  " + strings.Join(e.Problems, "\n  ")
+}
@@ -0,0 +1,22 @@
+package rkusb
+
+// Crc16 exposes the IDB checksum to the tests of package rkusb_test.
+var Crc16 = crc16
+
+// DecryptSector returns the RC4 decrypted copy of a 512 byte IDB sector.
+func DecryptSector(sector []byte) []byte {
+	data := append([]byte(nil), sector[:SectorSize]...)
+	pRC4(&data, 0, SectorSize)
+	return data
+}
+
+// RkCrc32 exposes the checksum of loader and parameter files.
+var RkCrc32 = rkCrc32
+
+// Rc4 returns the RC4 encrypted copy of data, the key stream starts at its
+// first byte. Encrypting twice returns the plain data.
+func Rc4(data []byte) []byte {
+	buf := append([]byte(nil), data...)
+	pRC4(&buf, 0, uint16(len(buf)))
+	return buf
+}
@@ -0,0 +1,460 @@
+package rkusb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"unicode/utf16"
+)
+
+const gptSignature = "EFI PART"
+const gptRevision = 0x00010000
+const gptHeaderSize = 92
+const gptEntryCount = 128
+const gptEntrySize = 128
+
+// gptEntrySectors is the size of the partition entry array.
+const gptEntrySectors = gptEntryCount * gptEntrySize / 512
+
+// LinuxDataGuid is the partition type used for partitions converted from
+// a parameter file.
+var LinuxDataGuid = MustParseGuid("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+
+// Guid is a GUID in the mixed endian layout used on disk.
+type Guid [16]byte
+
+func (g Guid) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]), binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]), g[8:10], g[10:16])
+}
+
+// ParseGuid parses a GUID in the form 0FC63DAF-8483-4772-8E79-3D69D8477DE4.
+func ParseGuid(s string) (Guid, error) {
+	var g Guid
+	fields := strings.Split(s, "-")
+	if len(fields) != 5 || len(fields[0]) != 8 || len(fields[1]) != 4 || len(fields[2]) != 4 ||
+		len(fields[3]) != 4 || len(fields[4]) != 12 {
+		return g, fmt.Errorf("invalid guid %s", s)
+	}
+	b, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return g, fmt.Errorf("invalid guid %s", s)
+	}
+	binary.LittleEndian.PutUint32(g[0:4], binary.BigEndian.Uint32(b[0:4]))
+	binary.LittleEndian.PutUint16(g[4:6], binary.BigEndian.Uint16(b[4:6]))
+	binary.LittleEndian.PutUint16(g[6:8], binary.BigEndian.Uint16(b[6:8]))
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+// MustParseGuid is ParseGuid for constants, it panics on invalid input.
+func MustParseGuid(s string) Guid {
+	g, err := ParseGuid(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// NewGuid returns a random version 4 GUID.
+func NewGuid() (Guid, error) {
+	var g Guid
+	_, err := rand.Read(g[:])
+	if err != nil {
+		return g, err
+	}
+	g[7] = g[7]&0x0F | 0x40
+	g[8] = g[8]&0x3F | 0x80
+	return g, nil
+}
+
+type GptHeader struct {
+	Signature                [8]byte
+	Revision                 uint32
+	HeaderSize               uint32
+	HeaderCrc32              uint32
+	Reserved                 uint32
+	MyLba                    uint64
+	AlternateLba             uint64
+	FirstUsableLba           uint64
+	LastUsableLba            uint64
+	DiskGuid                 Guid
+	PartitionEntryLba        uint64
+	NumPartitionEntries      uint32
+	SizeOfPartitionEntry     uint32
+	PartitionEntryArrayCrc32 uint32
+}
+
+type GptEntry struct {
+	TypeGuid   Guid
+	UniqueGuid Guid
+	FirstLba   uint64
+	LastLba    uint64
+	Attributes uint64
+	Name       [36]uint16
+}
+
+// Gpt is a GUID partition table, the LBAs are in sectors of 512 bytes and
+// the last LBA of a partition is inclusive.
+type Gpt struct {
+	DiskGuid       Guid           `json:"disk_guid"`
+	FirstUsableLba uint64         `json:"first_usable_lba"`
+	LastUsableLba  uint64         `json:"last_usable_lba"`
+	Partitions     []GptPartition `json:"partitions"`
+}
+
+type GptPartition struct {
+	Name       string `json:"name"`
+	TypeGuid   Guid   `json:"type_guid"`
+	UniqueGuid Guid   `json:"unique_guid"`
+	FirstLba   uint64 `json:"first_lba"`
+	LastLba    uint64 `json:"last_lba"`
+	Attributes uint64 `json:"attributes"`
+}
+
+func (g Guid) MarshalText() ([]byte, error) {
+	return []byte(g.String()), nil
+}
+
+func (g *Guid) UnmarshalText(text []byte) error {
+	guid, err := ParseGuid(string(text))
+	if err != nil {
+		return err
+	}
+	*g = guid
+	return nil
+}
+
+// ParameterToGpt converts the partitions of a parameter file to a GPT for a
+// device with the number of sectors. The offsets are kept, the growing
+// partition ends at the last usable LBA. GUIDs given by uuid:name=guid lines
+// of the parameter are used, all others are random.
+func ParameterToGpt(p *Parameter, sectors uint64) (*Gpt, error) {
+	if sectors <= 2*(gptEntrySectors+1)+1 {
+		return nil, fmt.Errorf("%d sectors are too small for a gpt", sectors)
+	}
+	diskGuid, err := NewGuid()
+	if err != nil {
+		return nil, err
+	}
+	g := &Gpt{
+		DiskGuid:       diskGuid,
+		FirstUsableLba: gptEntrySectors + 2,
+		LastUsableLba:  sectors - gptEntrySectors - 2,
+	}
+
+	uuids := map[string]string{}
+	for _, field := range p.Extra {
+		if strings.EqualFold(field.Key, "uuid") {
+			i := strings.Index(field.Value, "=")
+			if i > 0 {
+				uuids[field.Value[:i]] = field.Value[i+1:]
+			}
+		}
+	}
+
+	for _, part := range p.Partitions {
+		gp := GptPartition{
+			Name:     part.Name,
+			TypeGuid: LinuxDataGuid,
+			FirstLba: uint64(part.Offset),
+			LastLba:  uint64(part.Offset) + uint64(part.Size) - 1,
+		}
+		if part.Grow {
+			gp.LastLba = g.LastUsableLba
+		}
+		if uuid, ok := uuids[part.Name]; ok {
+			gp.UniqueGuid, err = ParseGuid(uuid)
+		} else {
+			gp.UniqueGuid, err = NewGuid()
+		}
+		if err != nil {
+			return nil, err
+		}
+		g.Partitions = append(g.Partitions, gp)
+	}
+	return g, g.check()
+}
+
+// check fails for partitions outside of the usable LBAs, overlapping
+// partitions and names that do not fit into an entry.
+func (g *Gpt) check() error {
+	if len(g.Partitions) > gptEntryCount {
+		return fmt.Errorf("a gpt holds at most %d partitions", gptEntryCount)
+	}
+	for i, part := range g.Partitions {
+		if len(utf16.Encode([]rune(part.Name))) > 36 {
+			return fmt.Errorf("partition name %s is longer than 36 characters", part.Name)
+		}
+		if part.FirstLba < g.FirstUsableLba || part.LastLba > g.LastUsableLba || part.LastLba < part.FirstLba {
+			return fmt.Errorf("partition %s at 0x%X-0x%X is outside of the usable lbas 0x%X-0x%X",
+				part.Name, part.FirstLba, part.LastLba, g.FirstUsableLba, g.LastUsableLba)
+		}
+		for _, other := range g.Partitions[:i] {
+			if part.FirstLba <= other.LastLba && other.FirstLba <= part.LastLba {
+				return fmt.Errorf("partition %s overlaps %s", part.Name, other.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Encode returns the protective MBR, primary header and entries for LBA 0 to
+// 33 and the backup entries and header for the last 33 LBAs of a device with
+// the number of sectors.
+func (g *Gpt) Encode(sectors uint64) ([]byte, []byte, error) {
+	err := g.check()
+	if err != nil {
+		return nil, nil, err
+	}
+	if g.LastUsableLba+gptEntrySectors+2 > sectors {
+		return nil, nil, fmt.Errorf("gpt ends at lba 0x%X, the device has 0x%X sectors", g.LastUsableLba, sectors)
+	}
+
+	entries := make([]GptEntry, gptEntryCount)
+	for i, part := range g.Partitions {
+		entries[i] = GptEntry{
+			TypeGuid:   part.TypeGuid,
+			UniqueGuid: part.UniqueGuid,
+			FirstLba:   part.FirstLba,
+			LastLba:    part.LastLba,
+			Attributes: part.Attributes,
+		}
+		copy(entries[i].Name[:], utf16.Encode([]rune(part.Name)))
+	}
+	var entryBuf bytes.Buffer
+	_ = binary.Write(&entryBuf, binary.LittleEndian, entries)
+
+	header := GptHeader{
+		Revision:                 gptRevision,
+		HeaderSize:               gptHeaderSize,
+		MyLba:                    1,
+		AlternateLba:             sectors - 1,
+		FirstUsableLba:           g.FirstUsableLba,
+		LastUsableLba:            g.LastUsableLba,
+		DiskGuid:                 g.DiskGuid,
+		PartitionEntryLba:        2,
+		NumPartitionEntries:      gptEntryCount,
+		SizeOfPartitionEntry:     gptEntrySize,
+		PartitionEntryArrayCrc32: crc32.ChecksumIEEE(entryBuf.Bytes()),
+	}
+	copy(header.Signature[:], gptSignature)
+
+	primary := make([]byte, (gptEntrySectors+2)*512)
+	copy(primary, protectiveMbr(sectors))
+	copy(primary[512:], encodeGptHeader(header))
+	copy(primary[1024:], entryBuf.Bytes())
+
+	header.MyLba, header.AlternateLba = sectors-1, 1
+	header.PartitionEntryLba = sectors - gptEntrySectors - 1
+	backup := make([]byte, (gptEntrySectors+1)*512)
+	copy(backup, entryBuf.Bytes())
+	copy(backup[gptEntrySectors*512:], encodeGptHeader(header))
+
+	return primary, backup, nil
+}
+
+func encodeGptHeader(header GptHeader) []byte {
+	header.HeaderCrc32 = 0
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, header)
+	header.HeaderCrc32 = crc32.ChecksumIEEE(buf.Bytes())
+	buf.Reset()
+	_ = binary.Write(&buf, binary.LittleEndian, header)
+	return buf.Bytes()
+}
+
+// protectiveMbr returns LBA 0 with a single partition of type 0xEE that
+// covers the whole device.
+func protectiveMbr(sectors uint64) []byte {
+	mbr := make([]byte, 512)
+	size := sectors - 1
+	if size > 0xFFFFFFFF {
+		size = 0xFFFFFFFF
+	}
+	entry := mbr[446:]
+	copy(entry[1:4], []byte{0x00, 0x02, 0x00})
+	entry[4] = 0xEE
+	copy(entry[5:8], []byte{0xFF, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(entry[8:], 1)
+	binary.LittleEndian.PutUint32(entry[12:], uint32(size))
+	mbr[510] = 0x55
+	mbr[511] = 0xAA
+	return mbr
+}
+
+// decodeGptHeader checks signature, size, CRC32 and position of the header
+// in the sector read from lba.
+func decodeGptHeader(sector []byte, lba uint64) (GptHeader, error) {
+	header := GptHeader{}
+	err := binary.Read(bytes.NewReader(sector), binary.LittleEndian, &header)
+	if err != nil {
+		return header, err
+	}
+	if string(header.Signature[:]) != gptSignature {
+		return header, fmt.Errorf("no gpt header at lba 0x%X: %w", lba, ErrNoGpt)
+	}
+	if header.HeaderSize < gptHeaderSize || header.HeaderSize > 512 {
+		return header, fmt.Errorf("unexpected gpt header size %d", header.HeaderSize)
+	}
+	raw := append([]byte{}, sector[0:header.HeaderSize]...)
+	binary.LittleEndian.PutUint32(raw[16:], 0)
+	if crc32.ChecksumIEEE(raw) != header.HeaderCrc32 {
+		return header, fmt.Errorf("gpt header at lba 0x%X: %w", lba, ErrGptChecksum)
+	}
+	if header.MyLba != lba {
+		return header, fmt.Errorf("gpt header at lba 0x%X claims lba 0x%X", lba, header.MyLba)
+	}
+	if header.SizeOfPartitionEntry < gptEntrySize || header.SizeOfPartitionEntry%8 != 0 ||
+		header.NumPartitionEntries > 1024 {
+		return header, fmt.Errorf("unexpected gpt entries %d of %d bytes", header.NumPartitionEntries, header.SizeOfPartitionEntry)
+	}
+	return header, nil
+}
+
+// decodeGptEntries checks the CRC32 of the entry array and returns the
+// used entries.
+func decodeGptEntries(header GptHeader, data []byte) (*Gpt, error) {
+	size := int(header.NumPartitionEntries * header.SizeOfPartitionEntry)
+	if len(data) < size {
+		return nil, fmt.Errorf("gpt entries exceed the data")
+	}
+	if crc32.ChecksumIEEE(data[0:size]) != header.PartitionEntryArrayCrc32 {
+		return nil, fmt.Errorf("gpt entries at lba 0x%X: %w", header.PartitionEntryLba, ErrGptChecksum)
+	}
+
+	g := &Gpt{
+		DiskGuid:       header.DiskGuid,
+		FirstUsableLba: header.FirstUsableLba,
+		LastUsableLba:  header.LastUsableLba,
+	}
+	for i := 0; i < int(header.NumPartitionEntries); i++ {
+		entry := GptEntry{}
+		offset := i * int(header.SizeOfPartitionEntry)
+		err := binary.Read(bytes.NewReader(data[offset:offset+gptEntrySize]), binary.LittleEndian, &entry)
+		if err != nil {
+			return nil, err
+		}
+		if entry.TypeGuid == (Guid{}) {
+			continue
+		}
+		name := entry.Name[:]
+		for j, c := range name {
+			if c == 0 {
+				name = name[0:j]
+				break
+			}
+		}
+		g.Partitions = append(g.Partitions, GptPartition{
+			Name:       string(utf16.Decode(name)),
+			TypeGuid:   entry.TypeGuid,
+			UniqueGuid: entry.UniqueGuid,
+			FirstLba:   entry.FirstLba,
+			LastLba:    entry.LastLba,
+			Attributes: entry.Attributes,
+		})
+	}
+	return g, nil
+}
+
+// ReadGpt reads the primary GPT, the backup at the end of the logical space
+// is used when the primary one is damaged. ReadDeviceData has to be called
+// before.
+func (rkDev *RkDevice) ReadGpt() (*Gpt, error) {
+	err := rkDev.initDeviceAsync()
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := rkDev.readGptAt(1)
+	if err == nil {
+		return g, nil
+	}
+	sectors := uint64(rkDev.LogicalSectors())
+	if sectors == 0 {
+		return nil, err
+	}
+	g, backupErr := rkDev.readGptAt(sectors - 1)
+	if backupErr != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (rkDev *RkDevice) readGptAt(lba uint64) (*Gpt, error) {
+	if lba > 0xFFFFFFFF {
+		return nil, fmt.Errorf("lba 0x%X is out of range", lba)
+	}
+	sector, err := rkDev.readLba(uint32(lba), 512, 0)
+	if err != nil {
+		return nil, err
+	}
+	header, err := decodeGptHeader(sector, lba)
+	if err != nil {
+		return nil, err
+	}
+
+	size := padSize(header.NumPartitionEntries * header.SizeOfPartitionEntry)
+	if header.PartitionEntryLba > 0xFFFFFFFF {
+		return nil, fmt.Errorf("gpt entries at lba 0x%X are out of range", header.PartitionEntryLba)
+	}
+	var entries []byte
+	for done := uint32(0); done < size; {
+		length := size - done
+		if length > lbaChunk*512 {
+			length = lbaChunk * 512
+		}
+		data, err := rkDev.readLba(uint32(header.PartitionEntryLba)+done/512, uint(length), 0)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, data...)
+		done += length
+	}
+	return decodeGptEntries(header, entries)
+}
+
+// WriteGpt writes the protective MBR, the primary and the backup GPT to the
+// logical space and reads them back. ReadDeviceData has to be called
+// before.
+func (rkDev *RkDevice) WriteGpt(g *Gpt) error {
+	sectors := uint64(rkDev.LogicalSectors())
+	primary, backup, err := g.Encode(sectors)
+	if err != nil {
+		return err
+	}
+
+	err = rkDev.initDeviceAsync()
+	if err != nil {
+		return err
+	}
+
+	copies := []struct {
+		lba  uint32
+		data []byte
+	}{
+		{0, primary},
+		{uint32(sectors) - gptEntrySectors - 1, backup},
+	}
+	for _, c := range copies {
+		err = rkDev.writeLba(c.lba, c.data, 0)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range copies {
+		data, err := rkDev.readLba(c.lba, uint(len(c.data)), 0)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, c.data) {
+			return &ErrVerifyMismatch{"gpt", c.lba}
+		}
+	}
+	return nil
+}
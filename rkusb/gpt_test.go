@@ -0,0 +1,168 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"testing"
+)
+
+const gptSectors = 0x10000
+
+func testGpt(t *testing.T) *rkusb.Gpt {
+	t.Helper()
+	p, err := rkusb.ParseParameter([]byte(layoutParameter + "uuid:boot=614E0000-0000-4B53-8000-1D28000054A9\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := rkusb.ParameterToGpt(p, gptSectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestParameterToGpt(t *testing.T) {
+	g := testGpt(t)
+	if g.FirstUsableLba != 34 || g.LastUsableLba != gptSectors-34 {
+		t.Errorf("usable lbas 0x%X-0x%X", g.FirstUsableLba, g.LastUsableLba)
+	}
+	want := []struct {
+		name  string
+		first uint64
+		last  uint64
+	}{
+		{"misc", 0x2000, 0x3FFF},
+		{"boot", 0x4000, 0xBFFF},
+		{"userdata", 0xC000, gptSectors - 34},
+	}
+	if len(g.Partitions) != len(want) {
+		t.Fatalf("%d partitions, want %d", len(g.Partitions), len(want))
+	}
+	for i, w := range want {
+		part := g.Partitions[i]
+		if part.Name != w.name || part.FirstLba != w.first || part.LastLba != w.last || part.TypeGuid != rkusb.LinuxDataGuid {
+			t.Errorf("partition %d is %+v, want %s at 0x%X-0x%X", i, part, w.name, w.first, w.last)
+		}
+	}
+	if guid := g.Partitions[1].UniqueGuid.String(); guid != "614E0000-0000-4B53-8000-1D28000054A9" {
+		t.Errorf("boot guid %s", guid)
+	}
+}
+
+// checkGptHeader decodes the header in sector and checks its LBAs and both
+// CRC32s against the entries.
+func checkGptHeader(t *testing.T, name string, sector []byte, entries []byte, myLba uint64, alternateLba uint64, entryLba uint64) {
+	t.Helper()
+	var header rkusb.GptHeader
+	err := binary.Read(bytes.NewReader(sector), binary.LittleEndian, &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(header.Signature[:]) != "EFI PART" || header.Revision != 0x10000 || header.HeaderSize != 92 {
+		t.Errorf("%s: signature %q, revision 0x%X, size %d", name, header.Signature, header.Revision, header.HeaderSize)
+	}
+	if header.MyLba != myLba || header.AlternateLba != alternateLba || header.PartitionEntryLba != entryLba {
+		t.Errorf("%s: lba 0x%X, alternate 0x%X, entries 0x%X", name, header.MyLba, header.AlternateLba, header.PartitionEntryLba)
+	}
+	if header.NumPartitionEntries != 128 || header.SizeOfPartitionEntry != 128 {
+		t.Errorf("%s: %d entries of %d bytes", name, header.NumPartitionEntries, header.SizeOfPartitionEntry)
+	}
+	if crc := crc32.ChecksumIEEE(entries); header.PartitionEntryArrayCrc32 != crc {
+		t.Errorf("%s: entries crc 0x%08X, want 0x%08X", name, header.PartitionEntryArrayCrc32, crc)
+	}
+	zeroed := append([]byte(nil), sector[:92]...)
+	copy(zeroed[16:20], []byte{0, 0, 0, 0})
+	if crc := crc32.ChecksumIEEE(zeroed); header.HeaderCrc32 != crc {
+		t.Errorf("%s: header crc 0x%08X, want 0x%08X", name, header.HeaderCrc32, crc)
+	}
+}
+
+func TestGptEncode(t *testing.T) {
+	g := testGpt(t)
+	primary, backup, err := g.Encode(gptSectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(primary) != 34*512 || len(backup) != 33*512 {
+		t.Fatalf("primary %d bytes, backup %d bytes", len(primary), len(backup))
+	}
+
+	mbr := primary[:512]
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		t.Error("no boot signature in the protective mbr")
+	}
+	entry := mbr[446:462]
+	if entry[4] != 0xEE || binary.LittleEndian.Uint32(entry[8:]) != 1 || binary.LittleEndian.Uint32(entry[12:]) != gptSectors-1 {
+		t.Errorf("protective partition %X", entry)
+	}
+	if !bytes.Equal(mbr[462:510], make([]byte, 48)) {
+		t.Error("more than one mbr partition")
+	}
+
+	entries := primary[1024:]
+	if !bytes.Equal(backup[:32*512], entries) {
+		t.Error("backup entries differ from the primary ones")
+	}
+	checkGptHeader(t, "primary", primary[512:1024], entries, 1, gptSectors-1, 2)
+	checkGptHeader(t, "backup", backup[32*512:], entries, gptSectors-1, 1, gptSectors-33)
+
+	var first rkusb.GptEntry
+	err = binary.Read(bytes.NewReader(entries), binary.LittleEndian, &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.FirstLba != 0x2000 || first.LastLba != 0x3FFF || first.Name[0] != 'm' || first.Name[4] != 0 {
+		t.Errorf("first entry %+v", first)
+	}
+}
+
+func TestReadGpt(t *testing.T) {
+	config := emulator.DefaultConfig()
+	config.FlashSize = gptSectors
+	emu, dev := newTestDevice(t, config)
+
+	g := testGpt(t)
+	err := dev.WriteGpt(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, backup, err := g.Encode(gptSectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(emu.ReadLba(0, 34), primary) || !bytes.Equal(emu.ReadLba(gptSectors-33, 33), backup) {
+		t.Fatal("written gpt differs from the encoded one")
+	}
+
+	read, err := dev.ReadGpt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, g) {
+		t.Errorf("got %+v\nwant %+v", read, g)
+	}
+
+	// a primary header with a wrong CRC32 falls back to the backup
+	header := emu.ReadLba(1, 1)
+	header[16] ^= 0xFF
+	emu.WriteLba(1, header)
+	read, err = dev.ReadGpt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, g) {
+		t.Errorf("backup: got %+v\nwant %+v", read, g)
+	}
+
+	// without the backup there is no gpt left
+	emu.WriteLba(gptSectors-1, make([]byte, 512))
+	_, err = dev.ReadGpt()
+	if !errors.Is(err, rkusb.ErrGptChecksum) && !errors.Is(err, rkusb.ErrNoGpt) {
+		t.Errorf("got %v, want a gpt error", err)
+	}
+}
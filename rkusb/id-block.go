@@ -1,15 +1,22 @@
-package main
+package rkusb
 
 import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
 )
 
 const IdbBlocks = 5
+
+// idbChipTag is the "RK28" tag in sec1 of every IDB, findIdBlock only accepts
+// blocks that carry it, whatever the chip is.
+const idbChipTag = 0x38324B52
 const SectorSize = 512
+
+// PhysicalSectorSize is the size of a NAND sector as transferred by the sector
+// commands: 512 bytes data, 3 spare bytes and the 13 byte BCH code.
+const PhysicalSectorSize = SectorSize + 16
 const MaxWriteSector = 16
 const ChipInfoLen = 16
 const RkAndroidSec2ReservedLen = 473
@@ -200,7 +207,7 @@ func (rkDev *RkDevice) getIdBData(idBCount int, secCount uint) ([]byte, error) {
 	if nSrc != -1 {
 		return data, nil
 	}
-	return nil, errors.New("idb data read error")
+	return nil, fmt.Errorf("idb data read error: %w", ErrNoIdBlock)
 }
 
 func (rkDev *RkDevice) readMultiSector(pos uint, count uint) ([]byte, error) {
@@ -260,16 +267,16 @@ func (rkDev *RkDevice) readIdB() error {
 	}
 
 	if !rkDev.idb.HasOldSec0 {
-		return errors.New("IDB read error sec0")
+		return fmt.Errorf("sec0 unreadable: %w", ErrNoIdBlock)
 	}
 	if !rkDev.idb.HasOldSec1 {
-		return errors.New("IDB read error sec1")
+		return fmt.Errorf("sec1 unreadable: %w", ErrNoIdBlock)
 	}
 	if !rkDev.idb.HasOldSec2 {
-		return errors.New("IDB read error sec2")
+		return fmt.Errorf("sec2 unreadable: %w", ErrNoIdBlock)
 	}
 	if !rkDev.idb.HasOldSec3 {
-		return errors.New("IDB read error sec3")
+		return fmt.Errorf("sec3 unreadable: %w", ErrNoIdBlock)
 	}
 	return nil
 }
@@ -284,12 +291,12 @@ func (rkDev *RkDevice) GetSerialNo() string {
 
 func (rkDev *RkDevice) GetMacAddress() string {
 	mac := rkDev.idb.OldSec3.MacAddr
-	return fmt.Sprintf("%0X:%0X:%0X:%0X:%0X:%0X", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
 }
 
 func (rkDev *RkDevice) GetBtAddress() string {
 	mac := rkDev.idb.OldSec3.BlueToothAddr
-	return fmt.Sprintf("%0X:%0X:%0X:%0X:%0X:%0X", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
 }
 
 func (rkDev *RkDevice) GetIMEI() string {
@@ -334,7 +341,7 @@ func (rkDev *RkDevice) GetUID() string {
 
 func (rkDev *RkDevice) SetSerialNo(sn string) error {
 	if len(sn) > RkDeviceSnLen {
-		return errors.New(fmt.Sprintf("max serial number length of %v characters exceeded", RkDeviceSnLen))
+		return fmt.Errorf("max serial number length of %v characters exceeded: %w", RkDeviceSnLen, ErrInvalidIdentity)
 	}
 	var sec3 = &rkDev.idb.OldSec3
 	sec3.SnSize = uint16(len(sn))
@@ -348,7 +355,7 @@ func (rkDev *RkDevice) SetSerialNo(sn string) error {
 
 func (rkDev *RkDevice) SetImei(imei string) error {
 	if len(imei) > RkDeviceImeiLen {
-		return errors.New(fmt.Sprintf("max IMEI length of %v characters exceeded", RkDeviceImeiLen))
+		return fmt.Errorf("max IMEI length of %v characters exceeded: %w", RkDeviceImeiLen, ErrInvalidIdentity)
 	}
 	var sec3 = &rkDev.idb.OldSec3
 	sec3.ImeiSize = byte(len(imei))
@@ -362,7 +369,7 @@ func (rkDev *RkDevice) SetImei(imei string) error {
 
 func (rkDev *RkDevice) SetUid(uid string) error {
 	if len(uid) > RkDeviceUidLen {
-		return errors.New(fmt.Sprintf("max UID length of %v characters exceeded", RkDeviceUidLen))
+		return fmt.Errorf("max UID length of %v characters exceeded: %w", RkDeviceUidLen, ErrInvalidIdentity)
 	}
 	var sec3 = &rkDev.idb.OldSec3
 	sec3.UidSize = byte(len(uid))
@@ -376,13 +383,13 @@ func (rkDev *RkDevice) SetUid(uid string) error {
 
 func (rkDev *RkDevice) SetMacAddr(mac string) error {
 	if len(mac) != RkDeviceMacLen*2 {
-		return errors.New(fmt.Sprintf("max MAC length of %v characters exceeded", RkDeviceMacLen))
+		return fmt.Errorf("MAC needs %v hex digits: %w", RkDeviceMacLen*2, ErrInvalidIdentity)
 	}
 	var sec3 = &rkDev.idb.OldSec3
 	sec3.MacSize = RkDeviceMacLen
 	data, err := hex.DecodeString(mac)
 	if err != nil {
-		return err
+		return fmt.Errorf("MAC %s: %w", mac, ErrInvalidIdentity)
 	}
 	for i := 0; i < RkDeviceMacLen; i++ {
 		sec3.MacAddr[i] = data[i]
@@ -392,13 +399,13 @@ func (rkDev *RkDevice) SetMacAddr(mac string) error {
 
 func (rkDev *RkDevice) SetBtAddr(bt string) error {
 	if len(bt) != RkDeviceBtLen*2 {
-		return errors.New(fmt.Sprintf("max bluetooth MAC length of %v characters exceeded", RkDeviceBtLen))
+		return fmt.Errorf("bluetooth MAC needs %v hex digits: %w", RkDeviceBtLen*2, ErrInvalidIdentity)
 	}
 	var sec3 = &rkDev.idb.OldSec3
 	sec3.BlueToothSize = RkDeviceBtLen
 	data, err := hex.DecodeString(bt)
 	if err != nil {
-		return err
+		return fmt.Errorf("bluetooth MAC %s: %w", bt, ErrInvalidIdentity)
 	}
 	for i := 0; i < RkDeviceBtLen; i++ {
 		sec3.BlueToothAddr[i] = data[i]
@@ -407,6 +414,9 @@ func (rkDev *RkDevice) SetBtAddr(bt string) error {
 }
 
 func (rkDev *RkDevice) writeIdB() error {
+	if rkDev.idb.oldIdBCount == 0 {
+		return fmt.Errorf("write id block: %w", ErrNoIdBlock)
+	}
 	sectors := uint(rkDev.idb.OldSec0.BootCodeSize +
 		rkDev.idb.OldSec0.BootDataSize -
 		rkDev.idb.OldSec0.BootCode1Offset)
@@ -414,7 +424,7 @@ func (rkDev *RkDevice) writeIdB() error {
 
 	var i uint
 	for i = 0; i < sectors; i += 0x10 {
-		var addr = ((rkDev.idb.idBlockOffset[0] * rkDev.flashInfo.SectorPerBlock) << 8) + i
+		var addr = (rkDev.idb.idBlockOffset[0]*rkDev.flashInfo.SectorPerBlock + i) << 8
 		var length uint = 0x10
 		if i+length > sectors {
 			length = sectors - i
@@ -428,84 +438,24 @@ func (rkDev *RkDevice) writeIdB() error {
 		backupBuffer.Write(data)
 	}
 
-	var sec0 = rkDev.idb.OldSec0
 	var sec1 = rkDev.idb.OldSec1
-	var sec2 = rkDev.idb.OldSec2
-	var sec3 = rkDev.idb.OldSec3
-
 	sec1.ReadWriteTimes += 1
 
-	var sec0Buffer bytes.Buffer
-	err := binary.Write(&sec0Buffer, binary.LittleEndian, sec0)
-	if err != nil {
-		return err
-	}
-	sec0Bytes := sec0Buffer.Bytes()
+	backup := backupBuffer.Bytes()
 
-	var sec1Buffer bytes.Buffer
-	err = binary.Write(&sec1Buffer, binary.LittleEndian, sec1)
-	if err != nil {
-		return err
+	var spare [4][3]byte
+	for n := 0; n < 4; n++ {
+		copy(spare[n][:], backup[n*(SectorSize+16)+SectorSize:])
 	}
-	sec1Bytes := sec1Buffer.Bytes()
 
-	var sec3Buffer bytes.Buffer
-	err = binary.Write(&sec3Buffer, binary.LittleEndian, sec3)
+	header, err := EncodeIdBSectors(rkDev.idb.OldSec0, sec1, rkDev.idb.OldSec2, rkDev.idb.OldSec3, spare)
 	if err != nil {
 		return err
 	}
-	sec3Bytes := sec3Buffer.Bytes()
-
-	sec2.Sec0Crc = crc16(sec0Bytes, SectorSize)
-	sec2.Sec1Crc = crc16(sec1Bytes, SectorSize)
-	sec2.Sec3Crc = crc16(sec3Bytes, SectorSize)
-
-	var sec2Buffer bytes.Buffer
-	err = binary.Write(&sec2Buffer, binary.LittleEndian, sec2)
-	if err != nil {
-		return err
-	}
-	sec2Bytes := sec2Buffer.Bytes()
-
-	pRC4(&sec0Bytes, 0, SectorSize)
-	pRC4(&sec1Bytes, 0, SectorSize)
-	pRC4(&sec3Bytes, 0, SectorSize)
-
-	backup := backupBuffer.Bytes()
-
-	for i := 512; i < 515; i++ {
-		sec0Bytes = append(sec0Bytes, backup[i])
-		sec1Bytes = append(sec1Bytes, backup[SectorSize+16+i])
-		sec2Bytes = append(sec2Bytes, backup[2*(SectorSize+16)+i])
-		sec3Bytes = append(sec3Bytes, backup[3*(SectorSize+16)+i])
-	}
-
-	var sec0BytesWithBch = bchEncode(sec0Bytes)
-	var sec1BytesWithBch = bchEncode(sec1Bytes)
-	var sec2BytesWithBch = bchEncode(sec2Bytes)
-	var sec3BytesWithBch = bchEncode(sec3Bytes)
 
 	var outBuffer bytes.Buffer
-	err = binary.Write(&outBuffer, binary.BigEndian, sec0BytesWithBch)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(&outBuffer, binary.BigEndian, sec1BytesWithBch)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(&outBuffer, binary.BigEndian, sec2BytesWithBch)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(&outBuffer, binary.BigEndian, sec3BytesWithBch)
-	if err != nil {
-		return err
-	}
-	err = binary.Write(&outBuffer, binary.BigEndian, backup[4*(SectorSize+16):])
-	if err != nil {
-		return err
-	}
+	outBuffer.Write(header)
+	outBuffer.Write(backup[4*(SectorSize+16):])
 	data := outBuffer.Bytes()
 
 	for n := 0; n < rkDev.idb.oldIdBCount; n++ {
@@ -518,13 +468,14 @@ func (rkDev *RkDevice) writeIdB() error {
 			if rkDev.idb.idBlockOffset[n] == 0 {
 				continue
 			}
-			addr := ((rkDev.idb.idBlockOffset[n] * rkDev.flashInfo.SectorPerBlock) << 8) + i
+			addr := (rkDev.idb.idBlockOffset[n]*rkDev.flashInfo.SectorPerBlock + i) << 8
 			var length uint16 = 0x10
 			if i+uint(length) > sectors {
 				length = uint16(sectors - i)
 			}
 
-			secData := data[i*528 : (i+0x10)*528]
+			// the last chunk can be shorter than 0x10 sectors
+			secData := data[i*PhysicalSectorSize : (i+uint(length))*PhysicalSectorSize]
 			err = rkDev.writeSector(uint32(addr), secData)
 			if err != nil {
 				return err
@@ -532,16 +483,77 @@ func (rkDev *RkDevice) writeIdB() error {
 
 			r, err := rkDev.readSector(uint32(addr), length)
 			if err != nil {
-				return nil
+				return err
 			}
 			if !bytes.Equal(r[0:SectorSize], secData[0:SectorSize]) {
-				return errors.New(fmt.Sprintf("error writing sector yx%04X", addr))
+				return &ErrVerifyMismatch{"IDB", uint32(addr >> 8)}
 			}
 		}
 	}
 	return nil
 }
 
+// EncodeIdBSectors encodes the four IDB header sectors the way they are stored
+// on NAND. The CRCs of sec0, sec1 and sec3 are stored in sec2, sec0, sec2 and
+// sec3 are RC4 encrypted and every sector is followed by its 3 spare bytes and
+// the BCH code, which results in 4 sectors of 528 bytes.
+func EncodeIdBSectors(sec0 RkAndroidIdBSec0, sec1 RkAndroidIdBSec1, sec2 RkAndroidIdBSec2, sec3 RkAndroidIdBSec3, spare [4][3]byte) ([]byte, error) {
+	var sec0Buffer bytes.Buffer
+	err := binary.Write(&sec0Buffer, binary.LittleEndian, sec0)
+	if err != nil {
+		return nil, err
+	}
+	sec0Bytes := sec0Buffer.Bytes()
+
+	var sec1Buffer bytes.Buffer
+	err = binary.Write(&sec1Buffer, binary.LittleEndian, sec1)
+	if err != nil {
+		return nil, err
+	}
+	sec1Bytes := sec1Buffer.Bytes()
+
+	var sec3Buffer bytes.Buffer
+	err = binary.Write(&sec3Buffer, binary.LittleEndian, sec3)
+	if err != nil {
+		return nil, err
+	}
+	sec3Bytes := sec3Buffer.Bytes()
+
+	sec2.Sec0Crc = crc16(sec0Bytes, SectorSize)
+	sec2.Sec1Crc = crc16(sec1Bytes, SectorSize)
+	sec2.Sec3Crc = crc16(sec3Bytes, SectorSize)
+
+	var sec2Buffer bytes.Buffer
+	err = binary.Write(&sec2Buffer, binary.LittleEndian, sec2)
+	if err != nil {
+		return nil, err
+	}
+	sec2Bytes := sec2Buffer.Bytes()
+
+	// sec1 is stored in plain text, like rkdeveloptool does and like
+	// getOldSectorData reads it, only sec0, sec2 and sec3 are encrypted
+	pRC4(&sec0Bytes, 0, SectorSize)
+	pRC4(&sec2Bytes, 0, SectorSize)
+	pRC4(&sec3Bytes, 0, SectorSize)
+
+	sec0Bytes = append(sec0Bytes, spare[0][:]...)
+	sec1Bytes = append(sec1Bytes, spare[1][:]...)
+	sec2Bytes = append(sec2Bytes, spare[2][:]...)
+	sec3Bytes = append(sec3Bytes, spare[3][:]...)
+
+	var sec0BytesWithBch = bchEncode(sec0Bytes)
+	var sec1BytesWithBch = bchEncode(sec1Bytes)
+	var sec2BytesWithBch = bchEncode(sec2Bytes)
+	var sec3BytesWithBch = bchEncode(sec3Bytes)
+
+	var outBuffer bytes.Buffer
+	outBuffer.Write(sec0BytesWithBch[:])
+	outBuffer.Write(sec1BytesWithBch[:])
+	outBuffer.Write(sec2BytesWithBch[:])
+	outBuffer.Write(sec3BytesWithBch[:])
+	return outBuffer.Bytes(), nil
+}
+
 func (rkDev *RkDevice) findAllIdB() error {
 	var start byte
 	rkDev.idb.oldIdBCount = 0
@@ -563,7 +575,7 @@ func (rkDev *RkDevice) findIdBlock(pos byte) (uint, error) {
 	i := rkDev.findValidBlocks(int(pos), 1)
 
 	if i < 0 {
-		return 0, errors.New("no valid id block found")
+		return 0, ErrNoIdBlock
 	}
 
 	for ; i < IdBlockTop; i = rkDev.findValidBlocks(i+1, 1) {
@@ -601,7 +613,7 @@ func (rkDev *RkDevice) findIdBlock(pos byte) (uint, error) {
 		return uint(i), nil
 	}
 
-	return 0, errors.New("no valid id block found")
+	return 0, ErrNoIdBlock
 }
 
 func (rkDev *RkDevice) findValidBlocks(begin int, len int) int {
@@ -0,0 +1,159 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"strings"
+	"testing"
+)
+
+func TestEncodeIdBSectors(t *testing.T) {
+	sec0 := rkusb.RkAndroidIdBSec0{
+		Tag:             0x0FF0AA55,
+		BootCode1Offset: 4,
+		BootCode2Offset: 4,
+		BootDataSize:    4,
+		BootCodeSize:    12,
+	}
+	sec1 := rkusb.RkAndroidIdBSec1{
+		SysReservedBlock: 0xC,
+		Disk0Size:        0xFFFF,
+		ChipTag:          0x38324B52,
+		ReadWriteTimes:   7,
+		IdBlock0:         2,
+	}
+	sec2 := rkusb.RkAndroidIdBSec2{
+		VcTag:  [3]byte{'V', 'C', 0},
+		CrcTag: [4]byte{'C', 'R', 'C', 0},
+	}
+	var sec3 rkusb.RkAndroidIdBSec3
+	sec3.SnSize = 8
+	copy(sec3.Sn[:], "TEST0123")
+	spare := [4][3]byte{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}, {10, 11, 12}}
+
+	header, err := rkusb.EncodeIdBSectors(sec0, sec1, sec2, sec3, spare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != 4*rkusb.PhysicalSectorSize {
+		t.Fatalf("%d bytes encoded, want 4 sectors", len(header))
+	}
+	sector := func(n int) []byte {
+		return header[n*rkusb.PhysicalSectorSize : n*rkusb.PhysicalSectorSize+rkusb.SectorSize]
+	}
+	for n := 0; n < 4; n++ {
+		got := header[n*rkusb.PhysicalSectorSize+rkusb.SectorSize:][:3]
+		if !bytes.Equal(got, spare[n][:]) {
+			t.Errorf("sec%d spare %v, want %v", n, got, spare[n])
+		}
+	}
+
+	// sec1 is stored in plain text, the other sectors are RC4 encrypted
+	plain := [][]byte{rkusb.DecryptSector(sector(0)), sector(1), rkusb.DecryptSector(sector(2)), rkusb.DecryptSector(sector(3))}
+	want := []interface{}{sec0, sec1, nil, sec3}
+	for n, value := range want {
+		if value == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.LittleEndian, value)
+		if !bytes.Equal(plain[n], buf.Bytes()) {
+			t.Errorf("sec%d differs after decoding", n)
+		}
+	}
+
+	var decoded rkusb.RkAndroidIdBSec2
+	err = binary.Read(bytes.NewReader(plain[2]), binary.LittleEndian, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.VcTag != sec2.VcTag || decoded.CrcTag != sec2.CrcTag {
+		t.Error("sec2 tags differ after decoding")
+	}
+	crcs := []struct {
+		name string
+		got  uint16
+		data []byte
+	}{
+		{"sec0", decoded.Sec0Crc, plain[0]},
+		{"sec1", decoded.Sec1Crc, plain[1]},
+		{"sec3", decoded.Sec3Crc, plain[3]},
+	}
+	for _, crc := range crcs {
+		if want := rkusb.Crc16(crc.data, rkusb.SectorSize); crc.got != want {
+			t.Errorf("%s crc 0x%04X, want 0x%04X", crc.name, crc.got, want)
+		}
+	}
+}
+
+func TestIdBlockRoundTrip(t *testing.T) {
+	sec0 := rkusb.RkAndroidIdBSec0{
+		Tag:             0x0FF0AA55,
+		BootCode1Offset: 4,
+		BootCode2Offset: 4,
+		BootDataSize:    4,
+		BootCodeSize:    12,
+	}
+	sec1 := rkusb.RkAndroidIdBSec1{
+		SysReservedBlock: 0xC,
+		Disk0Size:        0xFFFF,
+		ChipTag:          0x38324B52,
+		ReadWriteTimes:   7,
+		IdBlock0:         2,
+	}
+	var sec2 rkusb.RkAndroidIdBSec2
+	var sec3 rkusb.RkAndroidIdBSec3
+	sec3.SnSize = uint16(len(testSerial))
+	copy(sec3.Sn[:], testSerial)
+
+	header, err := rkusb.EncodeIdBSectors(sec0, sec1, sec2, sec3, [4][3]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu := emulator.New(emulator.DefaultConfig())
+	boot := make([]byte, 8*rkusb.PhysicalSectorSize)
+	err = emu.WriteIdBlock(2, append(header, boot...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the device accepts the block and reads the same values back
+	dev := rkusb.CreateRkDevice(emu)
+	err = dev.ReadDeviceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idb := dev.IdB()
+	if idb.OldSec0 != sec0 || idb.OldSec1 != sec1 || idb.OldSec3 != sec3 {
+		t.Error("device reads different sectors")
+	}
+	if dev.GetSerialNo() != testSerial {
+		t.Errorf("serial %q, want %q", dev.GetSerialNo(), testSerial)
+	}
+}
+
+func TestIdBErrors(t *testing.T) {
+	dev := rkusb.CreateRkDevice(emulator.New(emulator.DefaultConfig()))
+	err := dev.ReadDeviceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dev.WriteDeviceData()
+	if !errors.Is(err, rkusb.ErrNoIdBlock) {
+		t.Errorf("write without IDB: got %v, want ErrNoIdBlock", err)
+	}
+
+	for name, set := range map[string]func() error{
+		"serial": func() error { return dev.SetSerialNo(strings.Repeat("S", rkusb.RkDeviceSnLen+1)) },
+		"mac":    func() error { return dev.SetMacAddr("0011223344") },
+		"bt":     func() error { return dev.SetBtAddr("00112233445Z") },
+	} {
+		err = set()
+		if !errors.Is(err, rkusb.ErrInvalidIdentity) {
+			t.Errorf("%s: got %v, want ErrInvalidIdentity", name, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package rkusb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// IdBBuilder creates a complete IDB from the flash info, the chip info and
+// the FlashData and FlashBoot entries of a loader. Unlike writeIdB it does not
+// need an IDB on the device, so it can also restore blank or corrupted NAND.
+type IdBBuilder struct {
+	FlashInfo FlashInfo
+	ChipInfo  string
+	Loader    *RkLoader
+	// OldSec1 is the sec1 of the IDB that is replaced. Its reserved blocks,
+	// disk sizes and machine info are kept, without it the defaults of
+	// rkdeveloptool are used.
+	OldSec1 *RkAndroidIdBSec1
+	// Sec3 holds the device identity, it is written as is.
+	Sec3 RkAndroidIdBSec3
+	// IdBlocks are the blocks the IDB is written to, they are recorded in
+	// sec1.
+	IdBlocks []uint
+}
+
+// Build returns the physical sectors of an ID block: the four header sectors
+// followed by FlashData and FlashBoot, each of them padded to whole pages of
+// 2048 bytes. All sectors are 528 bytes long, the 3 spare bytes are zero and
+// followed by the BCH code.
+func (builder *IdBBuilder) Build() ([]byte, error) {
+	if builder.Loader == nil {
+		return nil, errors.New("no loader to build the id block from")
+	}
+	if len(builder.IdBlocks) > IdbBlocks {
+		return nil, fmt.Errorf("at most %v id blocks are supported", IdbBlocks)
+	}
+
+	flashData, err := loaderEntryData(builder.Loader, "FlashData")
+	if err != nil {
+		return nil, err
+	}
+	flashBoot, err := loaderEntryData(builder.Loader, "FlashBoot")
+	if err != nil {
+		return nil, err
+	}
+
+	flashDataSec := uint16(len(flashData) / SectorSize)
+	flashBootSec := uint16(len(flashBoot) / SectorSize)
+
+	sec0 := RkAndroidIdBSec0{
+		Tag:             0x0FF0AA55,
+		BootCode1Offset: 4,
+		BootCode2Offset: 4,
+		BootDataSize:    flashDataSec,
+		BootCodeSize:    flashDataSec + flashBootSec,
+	}
+
+	releaseTime := builder.Loader.ReleaseTime()
+	sec1 := builder.baseSec1()
+	sec1.LoaderYear = toBcd(releaseTime.Year())
+	sec1.LoaderDate = toBcd(int(releaseTime.Month()))<<8 | toBcd(releaseTime.Day())
+	sec1.LoaderVer = uint16(builder.Loader.Header.Version)
+	sec1.FlashSize = uint32(builder.FlashInfo.FlashSize * 1024)
+	sec1.AccessTime = builder.FlashInfo.AccessTime
+	sec1.BlockSize = uint16(builder.FlashInfo.SectorPerBlock)
+	sec1.PageSize = builder.FlashInfo.PageSize * 2
+	sec1.ECCBits = builder.FlashInfo.EccBits
+	idBlocks := []*uint16{&sec1.IdBlock0, &sec1.IdBlock1, &sec1.IdBlock2, &sec1.IdBlock3, &sec1.IdBlock4}
+	for i, block := range builder.IdBlocks {
+		*idBlocks[i] = uint16(block)
+	}
+
+	sec2 := RkAndroidIdBSec2{
+		VcTag:  [3]byte{'V', 'C', 0},
+		CrcTag: [4]byte{'C', 'R', 'C', 0},
+	}
+	copy(sec2.ChipInfo[:], builder.ChipInfo)
+
+	bootCode := append(flashData, flashBoot...)
+	if builder.Loader.Rc4Disabled() {
+		sec0.Rc4Flag = 1
+	} else {
+		for offset := 0; offset < len(bootCode); offset += SectorSize {
+			pRC4(&bootCode, uint32(offset), SectorSize)
+		}
+	}
+	sec2.BootCodeCrc = rkCrc32(bootCode)
+
+	header, err := EncodeIdBSectors(sec0, sec1, sec2, builder.Sec3, [4][3]byte{})
+	if err != nil {
+		return nil, err
+	}
+
+	var outBuffer bytes.Buffer
+	outBuffer.Write(header)
+	outBuffer.Write(encodeBootSectors(bootCode))
+	return outBuffer.Bytes(), nil
+}
+
+// baseSec1 returns the fields of sec1 that do not depend on the loader and
+// the flash: the ones of OldSec1 or the values rkdeveloptool writes.
+func (builder *IdBBuilder) baseSec1() RkAndroidIdBSec1 {
+	if builder.OldSec1 == nil {
+		return RkAndroidIdBSec1{
+			SysReservedBlock: 0xC,
+			Disk0Size:        0xFFFF,
+			ChipTag:          idbChipTag,
+		}
+	}
+	old := builder.OldSec1
+	return RkAndroidIdBSec1{
+		SysReservedBlock:    old.SysReservedBlock,
+		Disk0Size:           old.Disk0Size,
+		Disk1Size:           old.Disk1Size,
+		Disk2Size:           old.Disk2Size,
+		Disk3Size:           old.Disk3Size,
+		ChipTag:             idbChipTag,
+		MachineId:           old.MachineId,
+		LastLoaderVer:       old.LoaderVer,
+		ReadWriteTimes:      old.ReadWriteTimes + 1,
+		FwVer:               old.FwVer,
+		MachineInfoLen:      old.MachineInfoLen,
+		MachineInfo:         old.MachineInfo,
+		ManufacturerInfoLen: old.ManufacturerInfoLen,
+		ManufacturerInfo:    old.ManufacturerInfo,
+	}
+}
+
+func toBcd(value int) uint16 {
+	var bcd uint16
+	for shift := uint(0); value > 0; shift += 4 {
+		bcd |= uint16(value%10) << shift
+		value /= 10
+	}
+	return bcd
+}
+
+// RebuildIdB writes a new IDB built from the loader. It reads the chip info,
+// the flash info and the bad block map itself and does not need
+// ReadDeviceData, which fails on corrupted NAND. The ID blocks found on the
+// device are reused, on blank or corrupted NAND the first good blocks after
+// block 0 are taken. The sec1 data and the identity of sec3 are kept as far as
+// the old IDB is still readable.
+func (rkDev *RkDevice) RebuildIdB(loader *RkLoader) error {
+	err := rkDev.initDeviceAsync()
+	if err != nil {
+		return err
+	}
+	rkDev.chipInfo, err = rkDev.readChipInfo()
+	if err != nil {
+		return err
+	}
+	_, err = rkDev.readFlashInfo()
+	if err != nil {
+		return err
+	}
+	err = rkDev.testBadBlock()
+	if err != nil {
+		return err
+	}
+
+	// a damaged IDB is replaced anyway, only its readable parts are used
+	err = rkDev.reloadIdB()
+	if err != nil && !rkDev.idb.HasOldSec3 {
+		rkDev.idb.OldSec3 = RkAndroidIdBSec3{}
+	}
+
+	blocks := rkDev.idb.idBlockOffset[0:rkDev.idb.oldIdBCount]
+	if len(blocks) == 0 {
+		blocks = rkDev.freeIdBlocks()
+	}
+	if len(blocks) == 0 {
+		return errors.New("no good block left for the id block")
+	}
+
+	return rkDev.writeNewIdB(loader, blocks, rkDev.idb.OldSec3)
+}
+
+// writeNewIdB builds an IDB from the loader with the identity sec3, writes it
+// to blocks and reads it back into the cache. The sec1 data of the current
+// IDB is kept if there is one.
+func (rkDev *RkDevice) writeNewIdB(loader *RkLoader, blocks []uint, sec3 RkAndroidIdBSec3) error {
+	builder := IdBBuilder{
+		FlashInfo: rkDev.flashInfo,
+		ChipInfo:  rkDev.chipInfo,
+		Loader:    loader,
+		Sec3:      sec3,
+		IdBlocks:  blocks,
+	}
+	if rkDev.idb.HasOldSec1 {
+		builder.OldSec1 = &rkDev.idb.OldSec1
+	}
+
+	data, err := builder.Build()
+	if err != nil {
+		return err
+	}
+
+	err = rkDev.writeIdBlocks(data, blocks)
+	if err != nil {
+		return err
+	}
+
+	return rkDev.reloadIdB()
+}
+
+// freeIdBlocks returns up to IdbBlocks good blocks below IdBlockTop, block 0
+// is never used.
+func (rkDev *RkDevice) freeIdBlocks() []uint {
+	var blocks []uint
+	for i := rkDev.findValidBlocks(1, 1); i >= 0 && len(blocks) < IdbBlocks; i = rkDev.findValidBlocks(i+1, 1) {
+		blocks = append(blocks, uint(i))
+	}
+	return blocks
+}
@@ -0,0 +1,125 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"testing"
+)
+
+// testLoader returns a loader with one 471 and 472 entry and the FlashData
+// and FlashBoot entries of the IDB.
+func testLoader(t *testing.T) *rkusb.RkLoader {
+	t.Helper()
+	header := rkusb.RkBootHeader{Tag: 0x544F4F42, Size: 102, Version: 0x0203, ChipType: 0x33313241}
+	header.ReleaseTime = rkusb.RkTime{Year: 2021, Month: 3, Day: 4}
+	file := loaderFile(header, []testEntry{
+		{rkusb.Entry471, "DDR", bytes.Repeat([]byte{1}, 3000)},
+		{rkusb.Entry472, "usbplug", bytes.Repeat([]byte{2}, 3000)},
+		{rkusb.EntryLoader, "FlashData", bytes.Repeat([]byte{3}, 2500)},
+		{rkusb.EntryLoader, "FlashBoot", bytes.Repeat([]byte{4}, 2500)},
+	})
+
+	loader, err := rkusb.ReadLoader(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loader
+}
+
+func TestUpgradeLoaderKeepsSec1(t *testing.T) {
+	sec0 := rkusb.RkAndroidIdBSec0{
+		Tag:             0x0FF0AA55,
+		BootCode1Offset: 4,
+		BootCode2Offset: 4,
+		BootDataSize:    4,
+		BootCodeSize:    12,
+	}
+	sec1 := rkusb.RkAndroidIdBSec1{
+		SysReservedBlock: 0x20,
+		Disk0Size:        0x1234,
+		ChipTag:          0x38324B52,
+		MachineId:        42,
+		LoaderVer:        0x0101,
+		ReadWriteTimes:   3,
+		IdBlock0:         2,
+	}
+	sec2 := rkusb.RkAndroidIdBSec2{
+		VcTag:  [3]byte{'V', 'C', 0},
+		CrcTag: [4]byte{'C', 'R', 'C', 0},
+	}
+	var sec3 rkusb.RkAndroidIdBSec3
+	sec3.SnSize = uint16(len(testSerial))
+	copy(sec3.Sn[:], testSerial)
+	header, err := rkusb.EncodeIdBSectors(sec0, sec1, sec2, sec3, [4][3]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emu := emulator.New(emulator.DefaultConfig())
+	err = emu.WriteIdBlock(2, append(header, make([]byte, 8*rkusb.PhysicalSectorSize)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := rkusb.CreateRkDevice(emu)
+	err = dev.ReadDeviceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dev.UpgradeLoader(testLoader(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := dev.IdB().OldSec1
+	if got.SysReservedBlock != 0x20 || got.Disk0Size != 0x1234 || got.MachineId != 42 {
+		t.Errorf("chip data of sec1 not kept: %+v", got)
+	}
+	if got.LoaderVer != 0x0203 || got.LastLoaderVer != 0x0101 || got.ReadWriteTimes != 4 {
+		t.Errorf("loader version %X, last %X, writes %d", got.LoaderVer, got.LastLoaderVer, got.ReadWriteTimes)
+	}
+	if got.LoaderYear != 0x2021 || got.LoaderDate != 0x0304 {
+		t.Errorf("loader date %X %X", got.LoaderYear, got.LoaderDate)
+	}
+	if dev.GetSerialNo() != testSerial {
+		t.Errorf("serial %q, want %q", dev.GetSerialNo(), testSerial)
+	}
+}
+
+func TestRebuildIdBBlankNand(t *testing.T) {
+	emu := emulator.New(emulator.DefaultConfig())
+	dev := rkusb.CreateRkDevice(emu)
+	err := dev.RebuildIdB(testLoader(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := dev.Report()
+	if len(report.IdBlocks) != rkusb.IdbBlocks || report.IdBlocks[0] != 1 {
+		t.Errorf("id blocks %v", report.IdBlocks)
+	}
+	got := dev.IdB().OldSec1
+	if got.SysReservedBlock != 0xC || got.Disk0Size != 0xFFFF || got.ChipTag != 0x38324B52 {
+		t.Errorf("sec1 without the defaults: %+v", got)
+	}
+	if got.FlashSize != 0x1000000 || got.BlockSize != 0x200 {
+		t.Errorf("flash size 0x%X, block size 0x%X", got.FlashSize, got.BlockSize)
+	}
+}
+
+func TestRebuildIdBKeepsIdentity(t *testing.T) {
+	emu, _ := newTestDevice(t, emulator.DefaultConfig())
+	dev := rkusb.CreateRkDevice(emu)
+	err := dev.RebuildIdB(testLoader(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := dev.Report()
+	if len(report.IdBlocks) != 2 || report.IdBlocks[0] != 2 || report.IdBlocks[1] != 3 {
+		t.Errorf("id blocks %v, want [2 3]", report.IdBlocks)
+	}
+	if dev.GetSerialNo() != testSerial {
+		t.Errorf("serial %q, want %q", dev.GetSerialNo(), testSerial)
+	}
+}
@@ -0,0 +1,202 @@
+package rkusb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const idbDumpTag = 0x44424449
+const idbDumpVersion = 1
+
+// IdBDumpHeader starts an IDB dump file. It is followed by one IdBDumpBlock
+// per ID block and the raw 528 byte sectors of all blocks.
+type IdBDumpHeader struct {
+	Tag            uint32
+	Version        uint32
+	SectorSize     uint32
+	SectorPerBlock uint32
+	BlockCount     uint32
+}
+
+type IdBDumpBlock struct {
+	Block   uint32
+	Offset  uint32
+	Sectors uint32
+}
+
+// DumpIdB writes every ID block found on the device, the valid sectors at the
+// start of the block including spare bytes and BCH code, to w. ReadDeviceData
+// has to be called before.
+func (rkDev *RkDevice) DumpIdB(w io.Writer) error {
+	if rkDev.idb.oldIdBCount == 0 {
+		return fmt.Errorf("dump idb: %w", ErrNoIdBlock)
+	}
+
+	sectors := uint32(rkDev.flashInfo.SectorPerBlock)
+	// the loader only uses the first pages of a block for the IDB
+	valid := uint32(rkDev.flashInfo.ValidSecPerBlock)
+	if valid == 0 || valid > sectors {
+		valid = sectors
+	}
+	header := IdBDumpHeader{
+		Tag:            idbDumpTag,
+		Version:        idbDumpVersion,
+		SectorSize:     PhysicalSectorSize,
+		SectorPerBlock: sectors,
+		BlockCount:     uint32(rkDev.idb.oldIdBCount),
+	}
+
+	offset := uint32(binary.Size(header) + rkDev.idb.oldIdBCount*binary.Size(IdBDumpBlock{}))
+	blocks := make([]IdBDumpBlock, rkDev.idb.oldIdBCount)
+	for i := range blocks {
+		blocks[i] = IdBDumpBlock{
+			Block:   uint32(rkDev.idb.idBlockOffset[i]),
+			Offset:  offset,
+			Sectors: valid,
+		}
+		offset += valid * PhysicalSectorSize
+	}
+
+	err := binary.Write(w, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, blocks)
+	if err != nil {
+		return err
+	}
+
+	for _, block := range blocks {
+		var i uint32
+		for i = 0; i < block.Sectors; i += 0x10 {
+			var length uint32 = 0x10
+			if i+length > block.Sectors {
+				length = block.Sectors - i
+			}
+			addr := (block.Block*sectors + i) << 8
+			data, err := rkDev.readSector(addr, uint16(length))
+			if err != nil {
+				return err
+			}
+			if len(data) != int(length*PhysicalSectorSize) {
+				return fmt.Errorf("error reading sector 0x%04X", addr)
+			}
+			_, err = w.Write(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RestoreIdB writes the ID blocks of a dump created by DumpIdB back to the
+// blocks they were read from. Every block is erased first, sectors that were
+// erased when the dump was taken are not programmed. Blocks the device marks
+// bad are skipped, the restore fails when none is left. ReadDeviceData has to
+// be called before.
+func (rkDev *RkDevice) RestoreIdB(r io.Reader) error {
+	header := IdBDumpHeader{}
+	err := binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return err
+	}
+
+	if header.Tag != idbDumpTag {
+		return errors.New("unexpected idb dump signature")
+	}
+	if header.Version != idbDumpVersion || header.SectorSize != PhysicalSectorSize {
+		return errors.New("unsupported idb dump format")
+	}
+	if header.SectorPerBlock != uint32(rkDev.flashInfo.SectorPerBlock) {
+		return fmt.Errorf("idb dump was taken with %d sectors per block, the device has %d",
+			header.SectorPerBlock, rkDev.flashInfo.SectorPerBlock)
+	}
+	if header.BlockCount == 0 || header.BlockCount > IdbBlocks {
+		return errors.New("unexpected number of id blocks in dump")
+	}
+
+	blocks := make([]IdBDumpBlock, header.BlockCount)
+	err = binary.Read(r, binary.LittleEndian, blocks)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	base := uint32(binary.Size(header) + len(blocks)*binary.Size(IdBDumpBlock{}))
+
+	restored := 0
+	for _, block := range blocks {
+		if block.Sectors > header.SectorPerBlock || block.Block >= IdBlockTop {
+			return fmt.Errorf("invalid id block %d in dump", block.Block)
+		}
+		start := block.Offset - base
+		end := start + block.Sectors*PhysicalSectorSize
+		if block.Offset < base || int(end) > len(content) {
+			return fmt.Errorf("id block %d exceeds the dump", block.Block)
+		}
+		if rkDev.flashInfo.BlockState[block.Block] != 0 {
+			continue
+		}
+
+		err = rkDev.restoreIdBlock(block.Block, content[start:end])
+		if err != nil {
+			return err
+		}
+		restored++
+	}
+	if restored == 0 {
+		return errors.New("every id block of the dump is bad on the device")
+	}
+
+	return rkDev.reloadIdB()
+}
+
+func (rkDev *RkDevice) restoreIdBlock(block uint32, data []byte) error {
+	err := rkDev.eraseNormal(block, 1)
+	if err != nil {
+		return err
+	}
+
+	sectors := uint32(len(data) / PhysicalSectorSize)
+	erased := bytes.Repeat([]byte{0xFF}, PhysicalSectorSize)
+	var i uint32
+	for i = 0; i < sectors; {
+		if bytes.Equal(data[i*PhysicalSectorSize:(i+1)*PhysicalSectorSize], erased) {
+			i++
+			continue
+		}
+
+		// write the programmed sectors in runs of at most 16 sectors
+		length := uint32(1)
+		for length < 0x10 && i+length < sectors &&
+			!bytes.Equal(data[(i+length)*PhysicalSectorSize:(i+length+1)*PhysicalSectorSize], erased) {
+			length++
+		}
+
+		addr := (block*uint32(rkDev.flashInfo.SectorPerBlock) + i) << 8
+		secData := data[i*PhysicalSectorSize : (i+length)*PhysicalSectorSize]
+		err = rkDev.writeSector(addr, secData)
+		if err != nil {
+			return err
+		}
+
+		r, err := rkDev.readSector(addr, uint16(length))
+		if err != nil {
+			return err
+		}
+		err = compareSectorData(r, secData, addr)
+		if err != nil {
+			return err
+		}
+		i += length
+	}
+	return nil
+}
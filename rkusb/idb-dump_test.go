@@ -0,0 +1,108 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"testing"
+)
+
+func TestDumpRestoreIdB(t *testing.T) {
+	emu, dev := newTestDevice(t, emulator.DefaultConfig())
+	before, err := emu.Nand().Read(2*0x200, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	err = dev.DumpIdB(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dev.SetSerialNo("CHANGED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dev.WriteDeviceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dev.RestoreIdB(bytes.NewReader(dump.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := emu.Nand().Read(2*0x200, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("block 2 differs after the restore")
+	}
+
+	reopened := rkusb.CreateRkDevice(emu)
+	err = reopened.ReadDeviceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.GetSerialNo() != testSerial {
+		t.Errorf("serial %q after restore, want %q", reopened.GetSerialNo(), testSerial)
+	}
+}
+
+func TestDumpIdBValidSectors(t *testing.T) {
+	_, dev := newTestDevice(t, emulator.DefaultConfig())
+
+	var dump bytes.Buffer
+	err := dev.DumpIdB(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header, two block entries and the valid sectors of two blocks
+	valid := int(dev.FlashInfo().ValidSecPerBlock)
+	want := binary.Size(rkusb.IdBDumpHeader{}) + 2*binary.Size(rkusb.IdBDumpBlock{}) + 2*valid*rkusb.PhysicalSectorSize
+	if dump.Len() != want {
+		t.Errorf("dump of %d bytes, want %d", dump.Len(), want)
+	}
+}
+
+func TestRestoreIdBSkipsBadBlocks(t *testing.T) {
+	_, dev := newTestDevice(t, emulator.DefaultConfig())
+	var dump bytes.Buffer
+	err := dev.DumpIdB(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := emulator.DefaultConfig()
+	config.BadBlocks = []uint32{3}
+	target := rkusb.CreateRkDevice(emulator.New(config))
+	err = target.ReadDeviceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = target.RestoreIdB(bytes.NewReader(dump.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := target.Report()
+	if len(report.IdBlocks) != 1 || report.IdBlocks[0] != 2 {
+		t.Errorf("id blocks %v, want [2]", report.IdBlocks)
+	}
+	if target.GetSerialNo() != testSerial {
+		t.Errorf("serial %q, want %q", target.GetSerialNo(), testSerial)
+	}
+
+	config.BadBlocks = []uint32{2, 3}
+	target = rkusb.CreateRkDevice(emulator.New(config))
+	err = target.ReadDeviceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = target.RestoreIdB(bytes.NewReader(dump.Bytes()))
+	if err == nil {
+		t.Error("restore to bad blocks only succeeded")
+	}
+}
@@ -0,0 +1,57 @@
+package rkusb
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// CheckLayout checks that every .img part of the image the filter selects
+// lies inside the partition of the same name and does not overlap another
+// selected part. sectors is the size of the logical space that bounds
+// a growing partition. All problems are reported in one *ErrLayoutMismatch.
+func (rkImage *RkImage) CheckLayout(p *Parameter, filter PartFilter, sectors uint32) error {
+	var problems []string
+	var placed []RkImagePart
+
+	for _, part := range rkImage.ImageParts {
+		if !bytes.HasSuffix([]byte(part.File), []byte(".img")) || !filter.includes(part.Name) {
+			continue
+		}
+		start := uint64(part.NandAddr)
+		end := start + uint64(padSize(part.Size)/512)
+
+		partition, ok := p.Partition(part.Name)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: the parameter has no partition %s", part.Name, part.Name))
+		} else {
+			first := uint64(partition.Offset)
+			last := first + uint64(partition.Size)
+			if partition.Grow {
+				last = uint64(sectors)
+			}
+			switch {
+			case partition.Grow && sectors == 0:
+				problems = append(problems, fmt.Sprintf("%s: the end of growing partition %s is unknown without the flash size",
+					part.Name, partition.Name))
+			case start < first || end > last:
+				problems = append(problems, fmt.Sprintf("%s: 0x%X sectors at 0x%08X do not fit into partition %s at 0x%08X-0x%08X",
+					part.Name, end-start, start, partition.Name, first, last))
+			}
+		}
+
+		for _, other := range placed {
+			otherStart := uint64(other.NandAddr)
+			otherEnd := otherStart + uint64(padSize(other.Size)/512)
+			if start < otherEnd && otherStart < end {
+				problems = append(problems, fmt.Sprintf("%s: 0x%08X-0x%08X overlaps %s at 0x%08X-0x%08X",
+					part.Name, start, end, other.Name, otherStart, otherEnd))
+			}
+		}
+		placed = append(placed, part)
+	}
+
+	if len(problems) > 0 {
+		return &ErrLayoutMismatch{problems}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"strings"
+	"testing"
+)
+
+const layoutParameter = "CMDLINE: mtdparts=rk29xxnand:0x00002000@0x00002000(misc),0x00008000@0x00004000(boot),-@0x0000C000(userdata)\n"
+
+func TestCheckLayout(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	p, err := rkusb.ParseParameter([]byte(layoutParameter))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		parts   []testPart
+		filter  rkusb.PartFilter
+		sectors uint32
+		problem string
+	}{
+		{
+			name:    "fits",
+			parts:   []testPart{{"boot", "Image/boot.img", 0x4000, make([]byte, 0x8000*512)}},
+			sectors: 0x10000,
+		},
+		{
+			name:    "too big",
+			parts:   []testPart{{"misc", "Image/misc.img", 0x2000, make([]byte, 0x2001*512)}},
+			sectors: 0x10000,
+			problem: "misc: 0x2001 sectors at 0x00002000 do not fit",
+		},
+		{
+			name:    "inside",
+			parts:   []testPart{{"boot", "Image/boot.img", 0x4800, make([]byte, 0x7800*512)}},
+			sectors: 0x10000,
+		},
+		{
+			name:    "before the start",
+			parts:   []testPart{{"boot", "Image/boot.img", 0x3800, make([]byte, 512)}},
+			sectors: 0x10000,
+			problem: "boot: 0x1 sectors at 0x00003800 do not fit into partition boot at 0x00004000-0x0000C000",
+		},
+		{
+			name:    "beyond the end from inside",
+			parts:   []testPart{{"boot", "Image/boot.img", 0x4800, make([]byte, 0x8000*512)}},
+			sectors: 0x10000,
+			problem: "boot: 0x8000 sectors at 0x00004800 do not fit",
+		},
+		{
+			name:    "unknown partition",
+			parts:   []testPart{{"vendor", "Image/vendor.img", 0x4000, make([]byte, 512)}},
+			sectors: 0x10000,
+			problem: "the parameter has no partition vendor",
+		},
+		{
+			name:    "growing beyond the flash",
+			parts:   []testPart{{"userdata", "Image/userdata.img", 0xC000, make([]byte, 0x4001*512)}},
+			sectors: 0x10000,
+			problem: "userdata: 0x4001 sectors at 0x0000C000 do not fit into partition userdata at 0x0000C000-0x00010000",
+		},
+		{
+			name:    "unknown flash size",
+			parts:   []testPart{{"userdata", "Image/userdata.img", 0xC000, make([]byte, 512)}},
+			problem: "growing partition userdata is unknown",
+		},
+		{
+			name: "filtered",
+			parts: []testPart{
+				{"misc", "Image/misc.img", 0x2000, make([]byte, 0x2001*512)},
+				{"boot", "Image/boot.img", 0x4000, make([]byte, 512)},
+			},
+			filter:  rkusb.PartFilter{Skip: []string{"misc"}},
+			sectors: 0x10000,
+		},
+	}
+	for _, test := range tests {
+		rkImage := writeTestImage(t, dir, test.parts)
+		err := rkImage.CheckLayout(p, test.filter, test.sectors)
+		rkImage.File.Close()
+
+		if test.problem == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		var mismatch *rkusb.ErrLayoutMismatch
+		if !errors.As(err, &mismatch) {
+			t.Errorf("%s: got %v, want a layout mismatch", test.name, err)
+			continue
+		}
+		if len(mismatch.Problems) != 1 || !strings.Contains(mismatch.Problems[0], test.problem) {
+			t.Errorf("%s: problems %q, want %q", test.name, mismatch.Problems, test.problem)
+		}
+	}
+}
+
+func TestWriteImageReadsFlashSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := emulator.DefaultConfig()
+	config.FlashSize = 0x10000
+	emu := emulator.New(config)
+
+	// a growing partition that only fits without the flash size
+	rkImage := writeTestImage(t, dir, []testPart{
+		{"parameter", "parameter", 0, parameterBlob(t, layoutParameter)},
+		{"userdata", "Image/userdata.img", 0xC000, bytes.Repeat([]byte{1}, 0x4001*512)},
+	})
+	defer rkImage.File.Close()
+
+	// like flash, the device data is not read before
+	dev := rkusb.CreateRkDevice(emu)
+	err := dev.WriteImage(rkImage, nil)
+	var mismatch *rkusb.ErrLayoutMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("got %v, want a layout mismatch", err)
+	}
+	if dev.LogicalSectors() != 0x10000 {
+		t.Errorf("logical sectors 0x%X, want 0x10000", dev.LogicalSectors())
+	}
+}
+
+func TestWriteImageWithoutDeviceParameter(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	emu := emulator.New(emulator.DefaultConfig())
+	boot := bytes.Repeat([]byte{2}, 1024)
+	rkImage := writeTestImage(t, dir, []testPart{
+		{"parameter", "parameter", 0, parameterBlob(t, layoutParameter)},
+		{"boot", "Image/boot.img", 0x4000, boot},
+	})
+	defer rkImage.File.Close()
+
+	dev := rkusb.CreateRkDevice(emu)
+	filter := rkusb.PartFilter{Skip: []string{"parameter"}}
+	err := dev.WriteImageParts(rkImage, filter, nil)
+	if !errors.Is(err, rkusb.ErrNoParameter) {
+		t.Fatalf("got %v, want ErrNoParameter", err)
+	}
+
+	filter.NoLayoutCheck = true
+	err = dev.WriteImageParts(rkImage, filter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(emu.ReadLba(0x4000, 2), boot) {
+		t.Error("boot not written")
+	}
+}
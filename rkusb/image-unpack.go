@@ -0,0 +1,82 @@
+package rkusb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// reservedFile is the File of parts that only reserve space on the device,
+// e.g. backup, they carry no data.
+const reservedFile = "RESERVED"
+
+// VersionString returns the firmware version as major.minor.small.
+func (h RkFwHeader) VersionString() string {
+	return fmt.Sprintf("%d.%d.%d", h.Version>>24, (h.Version>>16)&0xFF, h.Version&0xFFFF)
+}
+
+// Date returns the build time of the image.
+func (h RkFwHeader) Date() string {
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", h.Year, h.Month, h.Day, h.Hour, h.Minute, h.Second)
+}
+
+// HasData tells if the part carries data, reserved parts only describe space
+// on the device.
+func (part RkImagePart) HasData() bool {
+	return part.File != reservedFile && part.Size > 0
+}
+
+// ExtractPart copies the data of the part to w.
+func (rkImage *RkImage) ExtractPart(part RkImagePart, w io.Writer) error {
+	if !part.HasData() {
+		return fmt.Errorf("part %s carries no data", part.Name)
+	}
+	n, err := io.Copy(w, io.NewSectionReader(rkImage.File, int64(part.Pos), int64(part.Size)))
+	if err != nil {
+		return err
+	}
+	if n != int64(part.Size) {
+		return fmt.Errorf("part %s exceeds the image", part.Name)
+	}
+	return nil
+}
+
+// UnpackPath returns the path below dir the part file, a relative path taken
+// from the image, is extracted to. Absolute paths and paths leaving dir are
+// refused.
+func UnpackPath(dir string, file string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(file))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to extract %s outside of %s", file, dir)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// ExtractLoader copies the loader the RKFW header points to to w.
+func (rkImage *RkImage) ExtractLoader(w io.Writer) error {
+	h := rkImage.FwHeader
+	if h.LoaderSize == 0 {
+		return errors.New("image contains no loader")
+	}
+	n, err := io.Copy(w, io.NewSectionReader(rkImage.File, int64(h.LoaderOffset), int64(h.LoaderSize)))
+	if err != nil {
+		return err
+	}
+	if n != int64(h.LoaderSize) {
+		return errors.New("loader exceeds the image")
+	}
+	return nil
+}
+
+// PackageFile returns the package-file manifest afptool builds the RKAF
+// firmware from, one line with name and relative path per part.
+func (rkImage *RkImage) PackageFile() string {
+	var manifest strings.Builder
+	manifest.WriteString("# NAME\tRelative path\n#\n")
+	for _, part := range rkImage.ImageParts {
+		fmt.Fprintf(&manifest, "%s\t%s\n", part.Name, part.File)
+	}
+	return manifest.String()
+}
@@ -0,0 +1,84 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"rockchipr/rkusb"
+	"testing"
+)
+
+func TestExtractPart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	boot := bytes.Repeat([]byte{2}, 700)
+	rkImage := writeTestImage(t, dir, []testPart{
+		{"parameter", "parameter.txt", 0, []byte("FIRMWARE_VER: 1.0\n")},
+		{"boot", "Image/boot.img", 0x4000, boot},
+		{"backup", "RESERVED", 0, nil},
+	})
+	defer rkImage.File.Close()
+
+	var data bytes.Buffer
+	err := rkImage.ExtractPart(rkImage.ImageParts[1], &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the padding of the part is left out
+	if !bytes.Equal(data.Bytes(), boot) {
+		t.Errorf("extracted %d bytes, want the %d bytes of boot", data.Len(), len(boot))
+	}
+
+	if rkImage.ImageParts[2].HasData() {
+		t.Error("reserved part carries data")
+	}
+	err = rkImage.ExtractPart(rkImage.ImageParts[2], &data)
+	if err == nil {
+		t.Error("extracted the reserved part")
+	}
+	err = rkImage.ExtractLoader(&data)
+	if err == nil {
+		t.Error("extracted a loader from an image without one")
+	}
+}
+
+func TestPackageFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkImage := writeTestImage(t, dir, []testPart{
+		{"parameter", "parameter.txt", 0, []byte("FIRMWARE_VER: 1.0\n")},
+		{"boot", "Image/boot.img", 0x4000, make([]byte, 512)},
+		{"backup", "RESERVED", 0, nil},
+	})
+	defer rkImage.File.Close()
+
+	want := "# NAME\tRelative path\n#\nparameter\tparameter.txt\nboot\tImage/boot.img\nbackup\tRESERVED\n"
+	if got := rkImage.PackageFile(); got != want {
+		t.Errorf("package-file\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUnpackPath(t *testing.T) {
+	dir := filepath.Join("out", "unpacked")
+	valid := map[string]string{
+		"Image/boot.img":     filepath.Join(dir, "Image", "boot.img"),
+		"parameter.txt":      filepath.Join(dir, "parameter.txt"),
+		"Image/../misc.img":  filepath.Join(dir, "misc.img"),
+		"./Image//uboot.img": filepath.Join(dir, "Image", "uboot.img"),
+	}
+	for file, want := range valid {
+		got, err := rkusb.UnpackPath(dir, file)
+		if err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", file, got, err, want)
+		}
+	}
+
+	for _, file := range []string{"..", "../boot.img", "Image/../../boot.img", "/etc/passwd"} {
+		_, err := rkusb.UnpackPath(dir, file)
+		if err == nil {
+			t.Errorf("%s: extracted outside of %s", file, dir)
+		}
+	}
+}
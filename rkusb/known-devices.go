@@ -0,0 +1,85 @@
+package rkusb
+
+// RockchipVendorId is the USB vendor id of all Rockchip SoCs in Maskrom and
+// loader mode.
+const RockchipVendorId = 0x2207
+
+// KnownDevice maps the product id a Rockchip SoC reports in Maskrom and
+// loader mode to the name of the chip.
+type KnownDevice struct {
+	ProductId uint16
+	Chip      string
+}
+
+// KnownDevices lists the product ids of the Rockchip SoCs, several chips of
+// the same family share a product id.
+var KnownDevices = []KnownDevice{
+	{0x281A, "RK2818"},
+	{0x290A, "RK2918"},
+	{0x292A, "RK2928"},
+	{0x292C, "RK3026"},
+	{0x300A, "RK3066"},
+	{0x300B, "RK3168"},
+	{0x301A, "RK3036"},
+	{0x310A, "RK3066B"},
+	{0x310B, "RK3188"},
+	{0x310C, "RK3126/RK3128"},
+	{0x320A, "RK3288"},
+	{0x320B, "RK3228/RK3229"},
+	{0x320C, "RK3328"},
+	{0x330A, "RK3368"},
+	{0x330C, "RK3399"},
+	{0x330D, "PX30/RK3326"},
+	{0x350A, "RK3566/RK3568"},
+	{0x350B, "RK3588"},
+	{0x180A, "RK1808"},
+	{0x110A, "RV1108"},
+	{0x110B, "RV1109/RV1126"},
+}
+
+// LookupDevice returns the known device with the vendor and product id.
+func LookupDevice(vendorId uint16, productId uint16) (KnownDevice, bool) {
+	if vendorId != RockchipVendorId {
+		return KnownDevice{}, false
+	}
+	for _, device := range KnownDevices {
+		if device.ProductId == productId {
+			return device, true
+		}
+	}
+	return KnownDevice{}, false
+}
+
+// UsbMode is the mode a Rockchip device is enumerated in.
+type UsbMode int
+
+const (
+	// ModeMaskrom is the boot ROM, only a loader can be downloaded.
+	ModeMaskrom UsbMode = iota
+	// ModeLoader is a loader running in RAM or from the IDB.
+	ModeLoader
+	// ModeMsc is a device that enumerates as USB mass storage, it does not
+	// accept loader commands.
+	ModeMsc
+)
+
+func (mode UsbMode) String() string {
+	switch mode {
+	case ModeMaskrom:
+		return "maskrom"
+	case ModeLoader:
+		return "loader"
+	case ModeMsc:
+		return "msc"
+	}
+	return "unknown"
+}
+
+// UsbModeFromBcd returns the mode from the bcdUSB field of the device
+// descriptor, the loader sets its lowest bit, the boot ROM does not.
+func UsbModeFromBcd(bcdUsb uint16) UsbMode {
+	if bcdUsb&0x0001 != 0 {
+		return ModeLoader
+	}
+	return ModeMaskrom
+}
@@ -0,0 +1,46 @@
+package rkusb_test
+
+import (
+	"rockchipr/rkusb"
+	"testing"
+)
+
+func TestLookupDevice(t *testing.T) {
+	tests := []struct {
+		vendorId  uint16
+		productId uint16
+		chip      string
+		ok        bool
+	}{
+		{0x2207, 0x310C, "RK3126/RK3128", true},
+		{0x2207, 0x350B, "RK3588", true},
+		{0x2207, 0x1234, "", false},
+		{0x1D6B, 0x310C, "", false},
+	}
+	for _, test := range tests {
+		device, ok := rkusb.LookupDevice(test.vendorId, test.productId)
+		if ok != test.ok || device.Chip != test.chip {
+			t.Errorf("%04X:%04X: %q %v, want %q %v", test.vendorId, test.productId, device.Chip, ok, test.chip, test.ok)
+		}
+		if ok && device.ProductId != test.productId {
+			t.Errorf("%04X:%04X: product id %04X", test.vendorId, test.productId, device.ProductId)
+		}
+	}
+}
+
+func TestUsbModeFromBcd(t *testing.T) {
+	tests := []struct {
+		bcdUsb uint16
+		want   rkusb.UsbMode
+	}{
+		{0x0200, rkusb.ModeMaskrom},
+		{0x0110, rkusb.ModeMaskrom},
+		{0x0201, rkusb.ModeLoader},
+		{0x0111, rkusb.ModeLoader},
+	}
+	for _, test := range tests {
+		if got := rkusb.UsbModeFromBcd(test.bcdUsb); got != test.want {
+			t.Errorf("bcdUSB 0x%04X: %v, want %v", test.bcdUsb, got, test.want)
+		}
+	}
+}
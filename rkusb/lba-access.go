@@ -0,0 +1,104 @@
+package rkusb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// lbaChunk is the number of 512 byte sectors moved by one LBA command,
+// WriteImage uses the same size.
+const lbaChunk = 0x800
+
+// ReadLba reads count sectors of 512 bytes starting at LBA start and writes
+// them to w. The reserved flag is passed to every command, the system
+// partition is read with 1.
+func (rkDev *RkDevice) ReadLba(start uint32, count uint32, w io.Writer, reserved byte, progress ProgressFunc) error {
+	err := rkDev.initDeviceAsync()
+	if err != nil {
+		return err
+	}
+
+	for done := uint32(0); done < count; {
+		length := count - done
+		if length > lbaChunk {
+			length = lbaChunk
+		}
+		data, err := rkDev.readLba(start+done, uint(length*512), reserved)
+		if err != nil {
+			return err
+		}
+		if len(data) != int(length*512) {
+			return fmt.Errorf("error reading lba 0x%08X", start+done)
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+		done += length
+		reportProgress(progress, "read", "lba", int(done), int(count))
+	}
+	return nil
+}
+
+// WriteLba writes everything read from r to the device starting at LBA
+// start, size is only used to report the progress. The last sector is padded
+// with zeros. The reserved flag is passed to every command, the system
+// partition is written with 1.
+func (rkDev *RkDevice) WriteLba(start uint32, r io.Reader, size int64, reserved byte, progress ProgressFunc) error {
+	err := rkDev.initDeviceAsync()
+	if err != nil {
+		return err
+	}
+
+	addr := start
+	written := 0
+	buf := make([]byte, lbaChunk*512)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		data := buf[0:padSize(uint32(n))]
+		for i := n; i < len(data); i++ {
+			data[i] = 0
+		}
+		err = rkDev.writeLba(addr, data, reserved)
+		if err != nil {
+			return err
+		}
+		addr += uint32(len(data) / 512)
+		written += n
+		reportProgress(progress, "write", "lba", written, int(size))
+
+		if n < len(buf) {
+			return nil
+		}
+	}
+}
+
+// EraseBlocks erases count blocks starting at block first, bad blocks are
+// skipped. ReadDeviceData has to be called before.
+func (rkDev *RkDevice) EraseBlocks(first uint, count uint) error {
+	if count == 0 {
+		return errors.New("nothing to erase")
+	}
+	if first+count > rkDev.flashInfo.BlockNum {
+		return fmt.Errorf("block %d is beyond the end of the flash", first+count-1)
+	}
+
+	for block := first; block < first+count; block++ {
+		if block < uint(len(rkDev.blockState)*8) && rkDev.blockState[block/8]&(1<<(block%8)) != 0 {
+			continue
+		}
+		err := rkDev.eraseNormal(uint32(block), 1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
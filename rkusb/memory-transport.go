@@ -0,0 +1,110 @@
+package rkusb
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errMemoryTransportEmpty = errors.New("no bulk in data queued")
+var errMemoryTransportClosed = errors.New("transport closed")
+
+// ControlRequest is a control transfer recorded by MemoryTransport.
+type ControlRequest struct {
+	RequestType byte
+	Request     byte
+	Value       uint16
+	Index       uint16
+	Data        []byte
+}
+
+// MemoryTransport is a Transport that keeps all transfers in memory. Every
+// bulk out transfer and control request is recorded, bulk in transfers are
+// answered from the packets queued with QueueIn. It is meant for tests and
+// tools that replay or inspect protocol traffic.
+type MemoryTransport struct {
+	mutex    sync.Mutex
+	in       [][]byte
+	out      [][]byte
+	controls []ControlRequest
+	closed   bool
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+// QueueIn appends packets that are returned by the following BulkIn calls,
+// one packet per call.
+func (t *MemoryTransport) QueueIn(packets ...[]byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, packet := range packets {
+		t.in = append(t.in, append([]byte(nil), packet...))
+	}
+}
+
+// Out returns all data sent with BulkOut so far.
+func (t *MemoryTransport) Out() [][]byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([][]byte(nil), t.out...)
+}
+
+// Controls returns all control requests sent so far.
+func (t *MemoryTransport) Controls() []ControlRequest {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]ControlRequest(nil), t.controls...)
+}
+
+func (t *MemoryTransport) BulkOut(data []byte, timeout time.Duration) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return 0, errMemoryTransportClosed
+	}
+	t.out = append(t.out, append([]byte(nil), data...))
+	return len(data), nil
+}
+
+func (t *MemoryTransport) BulkIn(maxLength int, timeout time.Duration) ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return nil, errMemoryTransportClosed
+	}
+	if len(t.in) == 0 {
+		return nil, errMemoryTransportEmpty
+	}
+	packet := t.in[0]
+	if len(packet) > maxLength {
+		t.in[0] = packet[maxLength:]
+		return packet[:maxLength], nil
+	}
+	t.in = t.in[1:]
+	return packet, nil
+}
+
+func (t *MemoryTransport) Control(requestType byte, request byte, value uint16, index uint16, data []byte, timeout time.Duration) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return 0, errMemoryTransportClosed
+	}
+	t.controls = append(t.controls, ControlRequest{
+		RequestType: requestType,
+		Request:     request,
+		Value:       value,
+		Index:       index,
+		Data:        append([]byte(nil), data...),
+	})
+	return len(data), nil
+}
+
+func (t *MemoryTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	return nil
+}
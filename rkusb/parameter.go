@@ -0,0 +1,457 @@
+package rkusb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParameterTag is PARM, the parameter file on the device and in update images
+// is stored as tag, length of the text, text and CRC32 of the text.
+const ParameterTag = 0x4D524150
+
+// Parameter holds the fields of a RK parameter file.
+type Parameter struct {
+	FirmwareVer  string `json:"firmware_ver"`
+	MachineModel string `json:"machine_model"`
+	MachineId    string `json:"machine_id"`
+	Manufacturer string `json:"manufacturer"`
+	Magic        uint32 `json:"magic"`
+	Atag         uint32 `json:"atag"`
+	Machine      uint32 `json:"machine"`
+	CheckMask    uint32 `json:"check_mask"`
+	KernelImg    uint32 `json:"kernel_img"`
+	CmdLine      string `json:"cmdline"`
+	// MtdId is the device name of the mtdparts list, e.g. rk29xxnand.
+	MtdId      string      `json:"mtd_id"`
+	Partitions []Partition `json:"partitions"`
+	// Extra are the lines with other keys, e.g. PWR_HLD or TYPE, in the
+	// order of the file.
+	Extra []ParameterField `json:"extra,omitempty"`
+}
+
+// ParameterField is a line of a parameter file.
+type ParameterField struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Partition is an entry of the mtdparts list, offset and size are in sectors
+// of 512 bytes. Grow is set for the last partition that takes the remaining
+// space, its size is 0.
+type Partition struct {
+	Name   string   `json:"name"`
+	Offset uint32   `json:"offset"`
+	Size   uint32   `json:"size"`
+	Grow   bool     `json:"grow"`
+	Flags  []string `json:"flags,omitempty"`
+}
+
+// ParseParameter parses a parameter file. The data is either the PARM blob
+// written to the device, whose CRC32 is verified, or the plain text.
+func ParseParameter(data []byte) (*Parameter, error) {
+	text, err := parameterText(data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Parameter{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid parameter line %q", line)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "FIRMWARE_VER":
+			p.FirmwareVer = value
+		case "MACHINE_MODEL":
+			p.MachineModel = value
+		case "MACHINE_ID":
+			p.MachineId = value
+		case "MANUFACTURER":
+			p.Manufacturer = value
+		case "MAGIC":
+			p.Magic, err = parameterNumber(key, value)
+		case "ATAG":
+			p.Atag, err = parameterNumber(key, value)
+		case "MACHINE":
+			p.Machine, err = parameterNumber(key, value)
+		case "CHECK_MASK":
+			p.CheckMask, err = parameterNumber(key, value)
+		case "KERNEL_IMG":
+			p.KernelImg, err = parameterNumber(key, value)
+		case "CMDLINE":
+			p.CmdLine = value
+			err = p.parseCmdLine()
+		default:
+			p.Extra = append(p.Extra, ParameterField{key, value})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Partition returns the partition with the name.
+func (p *Parameter) Partition(name string) (Partition, bool) {
+	for _, part := range p.Partitions {
+		if part.Name == name {
+			return part, true
+		}
+	}
+	return Partition{}, false
+}
+
+// Text returns the parameter file, the mtdparts option of the command line
+// is replaced by the one built from Partitions. The text is generated from
+// the fields, not kept from the parsed file: comments, blank lines and empty
+// or zero fields are left out and the known keys come first, so Text of a
+// parsed file parses to the same Parameter but is not the same text.
+func (p *Parameter) Text() string {
+	var text strings.Builder
+	writeField := func(key string, value string) {
+		if value != "" {
+			fmt.Fprintf(&text, "%s: %s\n", key, value)
+		}
+	}
+	writeNumber := func(key string, format string, value uint32) {
+		if value != 0 {
+			writeField(key, fmt.Sprintf(format, value))
+		}
+	}
+
+	writeField("FIRMWARE_VER", p.FirmwareVer)
+	writeField("MACHINE_MODEL", p.MachineModel)
+	writeField("MACHINE_ID", p.MachineId)
+	writeField("MANUFACTURER", p.Manufacturer)
+	writeNumber("MAGIC", "0x%08X", p.Magic)
+	writeNumber("ATAG", "0x%08X", p.Atag)
+	writeNumber("MACHINE", "%d", p.Machine)
+	writeNumber("CHECK_MASK", "0x%X", p.CheckMask)
+	writeNumber("KERNEL_IMG", "0x%08X", p.KernelImg)
+	for _, field := range p.Extra {
+		writeField(field.Key, field.Value)
+	}
+	writeField("CMDLINE", p.cmdLine())
+	return text.String()
+}
+
+// cmdLine returns the command line with the mtdparts option built from the
+// partitions.
+func (p *Parameter) cmdLine() string {
+	if len(p.Partitions) == 0 {
+		return p.CmdLine
+	}
+
+	mtdId := p.MtdId
+	if mtdId == "" {
+		mtdId = "rk29xxnand"
+	}
+	entries := make([]string, len(p.Partitions))
+	for i, part := range p.Partitions {
+		size := "-"
+		if !part.Grow {
+			size = fmt.Sprintf("0x%08X", part.Size)
+		}
+		name := strings.Join(append([]string{part.Name}, part.Flags...), ":")
+		entries[i] = fmt.Sprintf("%s@0x%08X(%s)", size, part.Offset, name)
+	}
+	mtdParts := "mtdparts=" + mtdId + ":" + strings.Join(entries, ",")
+
+	var options []string
+	for _, option := range strings.Fields(p.CmdLine) {
+		if strings.HasPrefix(option, "mtdparts=") {
+			option = mtdParts
+			mtdParts = ""
+		}
+		options = append(options, option)
+	}
+	if mtdParts != "" {
+		options = append(options, mtdParts)
+	}
+	return strings.Join(options, " ")
+}
+
+// Encode checks the partitions and returns the PARM blob, tag, length, text
+// and CRC32 of the text, as it is written to the device.
+func (p *Parameter) Encode() ([]byte, error) {
+	err := p.checkPartitions()
+	if err != nil {
+		return nil, err
+	}
+
+	text := []byte(p.Text())
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(ParameterTag))
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(text)))
+	buf.Write(text)
+	_ = binary.Write(&buf, binary.LittleEndian, rkCrc32(text))
+	return buf.Bytes(), nil
+}
+
+// checkPartitions fails for unnamed, duplicate, overlapping or unordered
+// partitions and a growing partition that is not the last one.
+func (p *Parameter) checkPartitions() error {
+	var end uint64
+	for i, part := range p.Partitions {
+		if part.Name == "" {
+			return fmt.Errorf("partition %d has no name", i)
+		}
+		for _, other := range p.Partitions[:i] {
+			if other.Name == part.Name {
+				return fmt.Errorf("partition %s is defined twice", part.Name)
+			}
+		}
+		if part.Grow && i != len(p.Partitions)-1 {
+			return fmt.Errorf("growing partition %s has to be the last one", part.Name)
+		}
+		if !part.Grow && part.Size == 0 {
+			return fmt.Errorf("partition %s has no size", part.Name)
+		}
+		if uint64(part.Offset) < end {
+			return fmt.Errorf("partition %s at 0x%08X overlaps the partition before", part.Name, part.Offset)
+		}
+		end = uint64(part.Offset) + uint64(part.Size)
+		if end > math.MaxUint32 {
+			return fmt.Errorf("partition %s exceeds 2 TiB", part.Name)
+		}
+	}
+	return nil
+}
+
+func parameterText(data []byte) (string, error) {
+	if len(data) >= 8 && binary.LittleEndian.Uint32(data) == ParameterTag {
+		length := binary.LittleEndian.Uint32(data[4:])
+		if uint64(length)+12 > uint64(len(data)) {
+			return "", errors.New("parameter length exceeds the data")
+		}
+		text := data[8 : 8+length]
+		if binary.LittleEndian.Uint32(data[8+length:]) != rkCrc32(text) {
+			return "", fmt.Errorf("parameter: %w", ErrParameterChecksum)
+		}
+		return string(text), nil
+	}
+
+	// the plain text is padded to full sectors
+	return string(bytes.TrimRight(data, "\x00")), nil
+}
+
+// ParseNumber parses a 0x prefixed hexadecimal or a decimal number, a leading
+// zero does not make it octal.
+func ParseNumber(s string) (uint32, error) {
+	var n uint64
+	var err error
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err = strconv.ParseUint(s[2:], 16, 32)
+	} else {
+		n, err = strconv.ParseUint(s, 10, 32)
+	}
+	return uint32(n), err
+}
+
+func parameterNumber(key string, value string) (uint32, error) {
+	n, err := ParseNumber(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q in parameter", key, value)
+	}
+	return n, nil
+}
+
+// parseCmdLine reads the partitions from the mtdparts option of the command
+// line, e.g. mtdparts=rk29xxnand:0x2000@0x2000(misc),-@0xc000(userdata:grow).
+func (p *Parameter) parseCmdLine() error {
+	var mtdParts string
+	for _, option := range strings.Fields(p.CmdLine) {
+		if strings.HasPrefix(option, "mtdparts=") {
+			mtdParts = strings.TrimPrefix(option, "mtdparts=")
+		}
+	}
+	if mtdParts == "" {
+		return nil
+	}
+
+	i := strings.Index(mtdParts, ":")
+	if i < 0 {
+		return fmt.Errorf("invalid mtdparts %q", mtdParts)
+	}
+	p.MtdId = mtdParts[:i]
+	p.Partitions = nil
+
+	var next uint32
+	for _, entry := range strings.Split(mtdParts[i+1:], ",") {
+		part, err := parseMtdPart(entry, next)
+		if err != nil {
+			return err
+		}
+		if p.Partitions != nil && p.Partitions[len(p.Partitions)-1].Grow {
+			return fmt.Errorf("partition %s follows the growing partition", part.Name)
+		}
+		p.Partitions = append(p.Partitions, part)
+		next = part.Offset + part.Size
+	}
+	return nil
+}
+
+// parseMtdPart parses size[@offset](name[:flags]), a partition without
+// offset starts at next.
+func parseMtdPart(entry string, next uint32) (Partition, error) {
+	open := strings.Index(entry, "(")
+	if open < 0 || !strings.HasSuffix(entry, ")") {
+		return Partition{}, fmt.Errorf("invalid mtdparts entry %q", entry)
+	}
+	names := strings.Split(entry[open+1:len(entry)-1], ":")
+	part := Partition{Name: names[0], Offset: next, Flags: names[1:]}
+	if part.Name == "" {
+		return Partition{}, fmt.Errorf("mtdparts entry %q has no name", entry)
+	}
+
+	size := entry[:open]
+	if i := strings.Index(size, "@"); i >= 0 {
+		offset, err := parameterNumber("offset of "+part.Name, size[i+1:])
+		if err != nil {
+			return Partition{}, err
+		}
+		part.Offset = offset
+		size = size[:i]
+	}
+	if size == "-" {
+		part.Grow = true
+	} else {
+		n, err := parameterNumber("size of "+part.Name, size)
+		if err != nil {
+			return Partition{}, err
+		}
+		part.Size = n
+	}
+	if len(part.Flags) == 0 {
+		part.Flags = nil
+	}
+	return part, nil
+}
+
+// Parameter parses the parameter part of the image.
+func (rkImage *RkImage) Parameter() (*Parameter, error) {
+	for _, part := range rkImage.ImageParts {
+		if part.Name != "parameter" {
+			continue
+		}
+		data := make([]byte, part.Size)
+		_, err := rkImage.File.ReadAt(data, int64(part.Pos))
+		if err != nil {
+			return nil, err
+		}
+		return ParseParameter(data)
+	}
+	return nil, errors.New("no parameters found in image file")
+}
+
+// ReadParameter reads and parses the parameter file from LBA 0 of the
+// device.
+func (rkDev *RkDevice) ReadParameter() (*Parameter, error) {
+	err := rkDev.initDeviceAsync()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := rkDev.readLba(0, 512, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 || binary.LittleEndian.Uint32(data) != ParameterTag {
+		return nil, ErrNoParameter
+	}
+
+	// tag, length and CRC32 around the text
+	size := padSize(binary.LittleEndian.Uint32(data[4:]) + 12)
+	if size > 0x400*512 {
+		return nil, fmt.Errorf("parameter on the device is too large: %w", ErrNoParameter)
+	}
+	if size > uint32(len(data)) {
+		data, err = rkDev.readLba(0, uint(size), 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ParseParameter(data)
+}
+
+// WriteParameter encodes the parameter and writes it to the device at the
+// same LBAs as WriteImage, every copy is read back and compared.
+func (rkDev *RkDevice) WriteParameter(p *Parameter, progress ProgressFunc) error {
+	data, err := p.Encode()
+	if err != nil {
+		return err
+	}
+	return rkDev.WriteParameterBlob(data, progress)
+}
+
+// WriteParameterBlob writes an encoded parameter to the device, see
+// WriteParameter.
+func (rkDev *RkDevice) WriteParameterBlob(data []byte, progress ProgressFunc) error {
+	if len(data) < 12 || binary.LittleEndian.Uint32(data) != ParameterTag {
+		return errors.New("parameter is not encoded")
+	}
+	_, err := ParseParameter(data)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0x400*512 {
+		return errors.New("parameter is too large")
+	}
+
+	err = rkDev.initDeviceAsync()
+	if err != nil {
+		return err
+	}
+
+	padded := make([]byte, padSize(uint32(len(data))))
+	copy(padded, data)
+	err = rkDev.writeParameterCopies("parameter", padded, progress)
+	if err != nil {
+		return err
+	}
+	return rkDev.verifyParameterCopies("parameter", padded, progress)
+}
+
+// writeParameterCopies writes the padded parameter to the 8 copies at
+// 0x0000 to 0x1c00.
+func (rkDev *RkDevice) writeParameterCopies(name string, data []byte, progress ProgressFunc) error {
+	var addr uint32 = 0x0000
+	for ; addr <= 0x1c00; addr += 0x0400 {
+		err := rkDev.writeLba(addr, data, 0)
+		if err != nil {
+			return err
+		}
+		reportProgress(progress, "write", name, int(addr), 0x1c00)
+	}
+	reportProgress(progress, "write", name, 0x1c00, 0x1c00)
+	return nil
+}
+
+func (rkDev *RkDevice) verifyParameterCopies(name string, data []byte, progress ProgressFunc) error {
+	var addr uint32 = 0
+	for ; addr <= 0x1c00; addr += 0x0400 {
+		r, err := rkDev.readLba(addr, uint(len(data)), 0)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(r, data) {
+			return &ErrVerifyMismatch{name, addr}
+		}
+		reportProgress(progress, "validate", name, int(addr), 0x1c00)
+	}
+	reportProgress(progress, "validate", name, 0x1c00, 0x1c00)
+	return nil
+}
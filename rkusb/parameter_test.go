@@ -0,0 +1,299 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"testing"
+	"time"
+)
+
+const testParameter = `# comment
+FIRMWARE_VER: 8.1
+MACHINE_MODEL: RK3128
+MACHINE_ID: 007
+MANUFACTURER: RK3128
+MAGIC: 0x5041524B
+ATAG: 0x00200800
+MACHINE: 3128
+CHECK_MASK: 0x80
+PWR_HLD: 0,0,A,0,1
+KERNEL_IMG: 0x00280000
+
+CMDLINE: console=ttyFIQ0 mtdparts=rk29xxnand:0x00002000@0x00002000(misc),0x00008000@0x00004000(boot:bootable),0x00010000(recovery),-@0x0001C000(userdata:grow) init=/init
+`
+
+func TestParseParameter(t *testing.T) {
+	p, err := rkusb.ParseParameter([]byte(testParameter))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &rkusb.Parameter{
+		FirmwareVer:  "8.1",
+		MachineModel: "RK3128",
+		MachineId:    "007",
+		Manufacturer: "RK3128",
+		Magic:        0x5041524B,
+		Atag:         0x00200800,
+		Machine:      3128,
+		CheckMask:    0x80,
+		KernelImg:    0x00280000,
+		CmdLine:      "console=ttyFIQ0 mtdparts=rk29xxnand:0x00002000@0x00002000(misc),0x00008000@0x00004000(boot:bootable),0x00010000(recovery),-@0x0001C000(userdata:grow) init=/init",
+		MtdId:        "rk29xxnand",
+		Partitions: []rkusb.Partition{
+			{Name: "misc", Offset: 0x2000, Size: 0x2000},
+			{Name: "boot", Offset: 0x4000, Size: 0x8000, Flags: []string{"bootable"}},
+			{Name: "recovery", Offset: 0xC000, Size: 0x10000},
+			{Name: "userdata", Offset: 0x1C000, Grow: true, Flags: []string{"grow"}},
+		},
+		Extra: []rkusb.ParameterField{{Key: "PWR_HLD", Value: "0,0,A,0,1"}},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("got %+v\nwant %+v", p, want)
+	}
+}
+
+func TestParseParameterNumbers(t *testing.T) {
+	p, err := rkusb.ParseParameter([]byte("MACHINE: 0100\nCHECK_MASK: 0X80\nCMDLINE: mtdparts=rk29xxnand:0100@0x0800(misc)\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a leading zero is decimal, not octal
+	if p.Machine != 100 || p.CheckMask != 0x80 {
+		t.Errorf("machine %d, check mask 0x%X, want 100 and 0x80", p.Machine, p.CheckMask)
+	}
+	if p.Partitions[0].Offset != 0x800 || p.Partitions[0].Size != 100 {
+		t.Errorf("partition %+v, want 100 sectors at 0x800", p.Partitions[0])
+	}
+}
+
+func TestParseParameterErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"no colon", "FIRMWARE_VER 8.1\n"},
+		{"invalid number", "MAGIC: PARM\n"},
+		{"octal", "MACHINE: 0o17\n"},
+		{"empty hex", "CHECK_MASK: 0x\n"},
+		{"no mtd id", "CMDLINE: mtdparts=0x2000@0x2000(misc)\n"},
+		{"no parenthesis", "CMDLINE: mtdparts=rk29xxnand:0x2000@0x2000\n"},
+		{"no name", "CMDLINE: mtdparts=rk29xxnand:0x2000@0x2000()\n"},
+		{"invalid size", "CMDLINE: mtdparts=rk29xxnand:big@0x2000(misc)\n"},
+		{"invalid offset", "CMDLINE: mtdparts=rk29xxnand:0x2000@here(misc)\n"},
+		{"after grow", "CMDLINE: mtdparts=rk29xxnand:-@0x2000(userdata),0x2000(misc)\n"},
+	}
+	for _, test := range tests {
+		_, err := rkusb.ParseParameter([]byte(test.text))
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestParameterEncodeRoundTrip(t *testing.T) {
+	p, err := rkusb.ParseParameter([]byte(testParameter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := p.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if binary.LittleEndian.Uint32(blob) != rkusb.ParameterTag {
+		t.Error("blob does not start with PARM")
+	}
+	length := binary.LittleEndian.Uint32(blob[4:])
+	if int(length)+12 != len(blob) {
+		t.Fatalf("length %d in a blob of %d bytes", length, len(blob))
+	}
+	text := blob[8 : 8+length]
+	if crc := binary.LittleEndian.Uint32(blob[8+length:]); crc != rkusb.RkCrc32(text) {
+		t.Errorf("crc 0x%08X, want 0x%08X", crc, rkusb.RkCrc32(text))
+	}
+
+	decoded, err := rkusb.ParseParameter(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the mtdparts option is rebuilt with the offset of every partition
+	cmdLine := "console=ttyFIQ0 mtdparts=rk29xxnand:0x00002000@0x00002000(misc),0x00008000@0x00004000(boot:bootable),0x00010000@0x0000C000(recovery),-@0x0001C000(userdata:grow) init=/init"
+	if decoded.CmdLine != cmdLine {
+		t.Errorf("command line %q, want %q", decoded.CmdLine, cmdLine)
+	}
+	decoded.CmdLine = p.CmdLine
+	if !reflect.DeepEqual(decoded, p) {
+		t.Errorf("got %+v\nwant %+v", decoded, p)
+	}
+
+	// the text is generated, comments and blank lines are gone
+	decoded, err = rkusb.ParseParameter(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := decoded.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, blob) {
+		t.Error("encoding the decoded parameter differs")
+	}
+	if bytes.Contains(text, []byte("#")) {
+		t.Error("comment in the generated text")
+	}
+}
+
+func TestParameterEncodeMtdParts(t *testing.T) {
+	p := &rkusb.Parameter{
+		CmdLine: "console=ttyFIQ0",
+		Partitions: []rkusb.Partition{
+			{Name: "misc", Offset: 0x2000, Size: 0x2000},
+			{Name: "userdata", Offset: 0x4000, Grow: true, Flags: []string{"grow"}},
+		},
+	}
+	want := "CMDLINE: console=ttyFIQ0 mtdparts=rk29xxnand:0x00002000@0x00002000(misc),-@0x00004000(userdata:grow)\n"
+	if p.Text() != want {
+		t.Errorf("got %q, want %q", p.Text(), want)
+	}
+}
+
+func TestParameterEncodeChecksPartitions(t *testing.T) {
+	tests := []struct {
+		name       string
+		partitions []rkusb.Partition
+	}{
+		{"no name", []rkusb.Partition{{Offset: 0x2000, Size: 0x2000}}},
+		{"twice", []rkusb.Partition{{Name: "misc", Offset: 0x2000, Size: 0x2000}, {Name: "misc", Offset: 0x4000, Size: 0x2000}}},
+		{"grow first", []rkusb.Partition{{Name: "userdata", Offset: 0x2000, Grow: true}, {Name: "misc", Offset: 0x4000, Size: 0x2000}}},
+		{"no size", []rkusb.Partition{{Name: "misc", Offset: 0x2000}}},
+		{"overlap", []rkusb.Partition{{Name: "misc", Offset: 0x2000, Size: 0x2000}, {Name: "boot", Offset: 0x3000, Size: 0x2000}}},
+		{"too big", []rkusb.Partition{{Name: "misc", Offset: 0xFFFFF000, Size: 0x2000}}},
+	}
+	for _, test := range tests {
+		p := &rkusb.Parameter{Partitions: test.partitions}
+		_, err := p.Encode()
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestRkCrc32(t *testing.T) {
+	tests := []struct {
+		data string
+		crc  uint32
+	}{
+		{"", 0},
+		{"a", 0xA862DB20},
+		{"123456789", 0x889A9615},
+		{"CMDLINE: mtdparts=rk29xxnand:0x00002000@0x00002000(misc),-@0x00004000(userdata:grow)\n", 0xF32787E9},
+	}
+	for _, test := range tests {
+		if crc := rkusb.RkCrc32([]byte(test.data)); crc != test.crc {
+			t.Errorf("crc of %q is 0x%08X, want 0x%08X", test.data, crc, test.crc)
+		}
+	}
+}
+
+func TestParameterChecksum(t *testing.T) {
+	blob := parameterBlob(t, "CMDLINE: mtdparts=rk29xxnand:-@0x00002000(userdata)\n")
+	blob[10] ^= 0xFF
+	_, err := rkusb.ParseParameter(blob)
+	if !errors.Is(err, rkusb.ErrParameterChecksum) {
+		t.Errorf("got %v, want ErrParameterChecksum", err)
+	}
+
+	_, err = rkusb.ParseParameter(blob[:20])
+	if err == nil {
+		t.Error("no error for a truncated blob")
+	}
+}
+
+func TestWriteParameterBlob(t *testing.T) {
+	emu, dev := newTestDevice(t, emulator.DefaultConfig())
+	blob := parameterBlob(t, layoutParameter)
+
+	err := dev.WriteParameterBlob(blob, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sectors := uint32(len(blob)+511) / 512
+	for lba := uint32(0x0000); lba <= 0x1C00; lba += 0x400 {
+		got := emu.ReadLba(lba, sectors)
+		if !bytes.Equal(got[:len(blob)], blob) || !bytes.Equal(got[len(blob):], make([]byte, len(got)-len(blob))) {
+			t.Errorf("copy at lba 0x%04X differs", lba)
+		}
+	}
+	// nothing is written between the copies
+	if got := emu.ReadLba(sectors, 0x400-sectors); !bytes.Equal(got, make([]byte, len(got))) {
+		t.Error("data after the first copy")
+	}
+
+	p, err := dev.ReadParameter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Partitions) != 3 {
+		t.Errorf("%d partitions read back, want 3", len(p.Partitions))
+	}
+}
+
+// corruptingTransport flips a bit in the data the emulator returns for a read
+// of the LBA.
+type corruptingTransport struct {
+	*emulator.Emulator
+	lba     uint32
+	corrupt bool
+}
+
+func (c *corruptingTransport) BulkOut(data []byte, timeout time.Duration) (int, error) {
+	if len(data) == 31 && data[15] == rkusb.ReadLba && binary.BigEndian.Uint32(data[17:21]) == c.lba {
+		c.corrupt = true
+	}
+	return c.Emulator.BulkOut(data, timeout)
+}
+
+func (c *corruptingTransport) BulkIn(maxLength int, timeout time.Duration) ([]byte, error) {
+	data, err := c.Emulator.BulkIn(maxLength, timeout)
+	if err == nil && c.corrupt && len(data) >= 512 {
+		data = append([]byte(nil), data...)
+		data[100] ^= 1
+		c.corrupt = false
+	}
+	return data, err
+}
+
+func TestWriteParameterBlobVerifyMismatch(t *testing.T) {
+	emu, _ := newTestDevice(t, emulator.DefaultConfig())
+	dev := rkusb.CreateRkDevice(&corruptingTransport{Emulator: emu, lba: 0x1400})
+
+	err := dev.WriteParameterBlob(parameterBlob(t, layoutParameter), nil)
+	var mismatch *rkusb.ErrVerifyMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("got %v, want ErrVerifyMismatch", err)
+	}
+	if mismatch.Partition != "parameter" || mismatch.LBA != 0x1400 {
+		t.Errorf("mismatch of %s at 0x%X, want parameter at 0x1400", mismatch.Partition, mismatch.LBA)
+	}
+}
+
+func TestWriteParameterBlobRefusesText(t *testing.T) {
+	_, dev := newTestDevice(t, emulator.DefaultConfig())
+	err := dev.WriteParameterBlob([]byte(layoutParameter), nil)
+	if err == nil {
+		t.Error("plain text written")
+	}
+
+	blob := parameterBlob(t, layoutParameter)
+	blob[len(blob)-1] ^= 0xFF
+	err = dev.WriteParameterBlob(blob, nil)
+	if !errors.Is(err, rkusb.ErrParameterChecksum) {
+		t.Errorf("got %v, want ErrParameterChecksum", err)
+	}
+}
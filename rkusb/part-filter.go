@@ -0,0 +1,55 @@
+package rkusb
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// PartFilter selects the parts of an update image WriteImageParts writes.
+// The parameter file is selected by the name parameter like any other part,
+// so naming only image parts in Partitions leaves the partition layout on the
+// device untouched.
+type PartFilter struct {
+	// Partitions are the names of the parts to write, all parts are written
+	// when it is empty.
+	Partitions []string
+	// Skip are the names of the parts not to write.
+	Skip []string
+	// NoLayoutCheck writes the parts without checking them against the
+	// parameter, for devices without a readable one.
+	NoLayoutCheck bool
+}
+
+func (filter PartFilter) includes(name string) bool {
+	if len(filter.Partitions) > 0 && !containsName(filter.Partitions, name) {
+		return false
+	}
+	return !containsName(filter.Skip, name)
+}
+
+// check fails when the filter names a part the image does not contain, a
+// typo would otherwise silently write nothing.
+func (filter PartFilter) check(rkImage *RkImage) error {
+	var names []string
+	for _, part := range rkImage.ImageParts {
+		if part.Name == "parameter" || bytes.HasSuffix([]byte(part.File), []byte(".img")) {
+			names = append(names, part.Name)
+		}
+	}
+	for _, name := range append(append([]string{}, filter.Partitions...), filter.Skip...) {
+		if !containsName(names, name) {
+			return fmt.Errorf("image has no partition %s, it contains %s", name, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"os"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"strings"
+	"testing"
+)
+
+func TestWriteImagePartsFilter(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	misc := bytes.Repeat([]byte{1}, 512)
+	boot := bytes.Repeat([]byte{2}, 512)
+	rkImage := writeTestImage(t, dir, []testPart{
+		{"parameter", "parameter", 0, parameterBlob(t, layoutParameter)},
+		{"misc", "Image/misc.img", 0x2000, misc},
+		{"boot", "Image/boot.img", 0x4000, boot},
+	})
+	defer rkImage.File.Close()
+
+	tests := []struct {
+		name      string
+		filter    rkusb.PartFilter
+		parameter bool
+		misc      bool
+		boot      bool
+	}{
+		{name: "all", parameter: true, misc: true, boot: true},
+		{name: "partition", filter: rkusb.PartFilter{Partitions: []string{"boot"}}, boot: true},
+		{name: "skip", filter: rkusb.PartFilter{Skip: []string{"parameter", "misc"}}, boot: true},
+		{name: "partition and skip", filter: rkusb.PartFilter{Partitions: []string{"misc", "boot"}, Skip: []string{"boot"}}, misc: true},
+	}
+	for _, test := range tests {
+		emu := emulator.New(emulator.DefaultConfig())
+		// without the parameter the parts are checked against the one on
+		// the device
+		oldParameter := parameterBlob(t, "FIRMWARE_VER: 1.0\n"+layoutParameter)
+		emu.WriteLba(0, oldParameter)
+
+		dev := rkusb.CreateRkDevice(emu)
+		err := dev.WriteImageParts(rkImage, test.filter, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		onDevice := emu.ReadLba(0, uint32(len(oldParameter)+511)/512)
+		parameter := !bytes.Equal(onDevice[:len(oldParameter)], oldParameter)
+		if parameter != test.parameter {
+			t.Errorf("%s: parameter written %v, want %v", test.name, parameter, test.parameter)
+		}
+		if got := bytes.Equal(emu.ReadLba(0x2000, 1), misc); got != test.misc {
+			t.Errorf("%s: misc written %v, want %v", test.name, got, test.misc)
+		}
+		if got := bytes.Equal(emu.ReadLba(0x4000, 1), boot); got != test.boot {
+			t.Errorf("%s: boot written %v, want %v", test.name, got, test.boot)
+		}
+	}
+}
+
+func TestWriteImagePartsUnknownName(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkImage := writeTestImage(t, dir, []testPart{
+		{"parameter", "parameter", 0, parameterBlob(t, layoutParameter)},
+		{"boot", "Image/boot.img", 0x4000, make([]byte, 512)},
+	})
+	defer rkImage.File.Close()
+
+	emu := emulator.New(emulator.DefaultConfig())
+	dev := rkusb.CreateRkDevice(emu)
+	for _, filter := range []rkusb.PartFilter{
+		{Partitions: []string{"bot"}},
+		{Skip: []string{"userdata"}},
+	} {
+		err := dev.WriteImageParts(rkImage, filter, nil)
+		if err == nil || !strings.Contains(err.Error(), "image has no partition") {
+			t.Errorf("%+v: got %v, want an unknown partition error", filter, err)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package rkusb
 
 func pRC4(buf *[]byte, offset uint32, len uint16) {
 	var s [256]byte
@@ -0,0 +1,135 @@
+package rkusb
+
+import "fmt"
+
+// ReportSchemaVersion is increased whenever a field of DeviceReport changes
+// its meaning or is removed. New fields do not change the version.
+const ReportSchemaVersion = 1
+
+// DeviceReport is the machine readable summary of ReadDeviceData.
+type DeviceReport struct {
+	SchemaVersion int             `json:"schema_version"`
+	ChipInfo      string          `json:"chip_info"`
+	FlashInfo     FlashInfoReport `json:"flash_info"`
+	BadBlocks     []uint          `json:"bad_blocks"`
+	IdBlocks      []uint          `json:"id_blocks"`
+	Loader        LoaderReport    `json:"loader"`
+	Identity      IdentityReport  `json:"identity"`
+}
+
+// FlashInfoReport holds the flash info, FlashSize is the size of the logical
+// space in MB.
+type FlashInfoReport struct {
+	Manufacturer     string `json:"manufacturer"`
+	FlashSize        uint   `json:"flash_size_mb"`
+	BlockSize        uint   `json:"block_size"`
+	PageSize         byte   `json:"page_size"`
+	SectorPerBlock   uint   `json:"sector_per_block"`
+	BlockNum         uint   `json:"block_num"`
+	EccBits          byte   `json:"ecc_bits"`
+	AccessTime       byte   `json:"access_time"`
+	FlashCs          byte   `json:"flash_cs"`
+	ValidSecPerBlock uint   `json:"valid_sec_per_block"`
+	PhyBlockPerIDB   uint   `json:"phy_block_per_idb"`
+	SecNumPerIDB     uint   `json:"sec_num_per_idb"`
+}
+
+// LoaderReport holds the decoded fields of IDB sector 1.
+type LoaderReport struct {
+	LoaderVersion     string `json:"loader_version"`
+	LastLoaderVersion string `json:"last_loader_version"`
+	LoaderDate        string `json:"loader_date"`
+	ReadWriteTimes    uint16 `json:"read_write_times"`
+	FwVersion         string `json:"fw_version"`
+	ChipTag           string `json:"chip_tag"`
+	MachineId         uint32 `json:"machine_id"`
+	MachineInfo       string `json:"machine_info"`
+	ManufacturerInfo  string `json:"manufacturer_info"`
+	SysReservedBlock  uint16 `json:"sys_reserved_block"`
+}
+
+// IdentityReport holds the identity fields of IDB sector 3.
+type IdentityReport struct {
+	SerialNo   string `json:"sn"`
+	Imei       string `json:"imei"`
+	Uid        string `json:"uid"`
+	MacAddress string `json:"mac"`
+	BtAddress  string `json:"bt"`
+}
+
+func (rkDev *RkDevice) Report() DeviceReport {
+	fi := rkDev.flashInfo
+	sec1 := rkDev.idb.OldSec1
+
+	badBlocks := []uint{}
+	for i := 0; i < len(rkDev.blockState)*8; i++ {
+		if rkDev.blockState[i/8]&(1<<uint(i%8)) != 0 {
+			badBlocks = append(badBlocks, uint(i))
+		}
+	}
+
+	idBlocks := append([]uint{}, rkDev.idb.idBlockOffset[0:rkDev.idb.oldIdBCount]...)
+
+	return DeviceReport{
+		SchemaVersion: ReportSchemaVersion,
+		ChipInfo:      bytesToString([]byte(rkDev.chipInfo)),
+		FlashInfo: FlashInfoReport{
+			Manufacturer:     fi.Manufacturer,
+			FlashSize:        fi.FlashSize / 2,
+			BlockSize:        fi.BlockSize,
+			PageSize:         fi.PageSize,
+			SectorPerBlock:   fi.SectorPerBlock,
+			BlockNum:         fi.BlockNum,
+			EccBits:          fi.EccBits,
+			AccessTime:       fi.AccessTime,
+			FlashCs:          fi.FlashCs,
+			ValidSecPerBlock: fi.ValidSecPerBlock,
+			PhyBlockPerIDB:   fi.PhyBlockPerIDB,
+			SecNumPerIDB:     fi.SecNumPerIDB,
+		},
+		BadBlocks: badBlocks,
+		IdBlocks:  idBlocks,
+		Loader: LoaderReport{
+			LoaderVersion:     bcdVersion(sec1.LoaderVer),
+			LastLoaderVersion: bcdVersion(sec1.LastLoaderVer),
+			LoaderDate:        fmt.Sprintf("%04x-%02x-%02x", sec1.LoaderYear, sec1.LoaderDate>>8, sec1.LoaderDate&0xFF),
+			ReadWriteTimes:    sec1.ReadWriteTimes,
+			FwVersion:         fmt.Sprintf("%d.%d.%02d", (sec1.FwVer>>24)&0xFF, (sec1.FwVer>>16)&0xFF, sec1.FwVer&0xFFFF),
+			ChipTag:           bytesToString([]byte{byte(sec1.ChipTag), byte(sec1.ChipTag >> 8), byte(sec1.ChipTag >> 16), byte(sec1.ChipTag >> 24)}),
+			MachineId:         sec1.MachineId,
+			MachineInfo:       fixedString(sec1.MachineInfo[:], int(sec1.MachineInfoLen)),
+			ManufacturerInfo:  fixedString(sec1.ManufacturerInfo[:], int(sec1.ManufacturerInfoLen)),
+			SysReservedBlock:  sec1.SysReservedBlock,
+		},
+		Identity: IdentityReport{
+			SerialNo:   rkDev.GetSerialNo(),
+			Imei:       rkDev.GetIMEI(),
+			Uid:        rkDev.GetUID(),
+			MacAddress: rkDev.GetMacAddress(),
+			BtAddress:  rkDev.GetBtAddress(),
+		},
+	}
+}
+
+func bcdVersion(version uint16) string {
+	return fmt.Sprintf("%x.%02x", version>>8, version&0xFF)
+}
+
+// fixedString returns the first length bytes of a fixed size field up to the
+// first zero byte, other non printable characters are dropped.
+func fixedString(field []byte, length int) string {
+	if length > len(field) {
+		length = len(field)
+	}
+	s := ""
+	for _, c := range field[0:length] {
+		if c == 0 {
+			break
+		}
+		if c < 0x20 || c > 0x7E {
+			continue
+		}
+		s += string(c)
+	}
+	return s
+}
@@ -0,0 +1,92 @@
+package rkusb_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"sort"
+	"testing"
+)
+
+func TestReportJson(t *testing.T) {
+	config := emulator.DefaultConfig()
+	config.BadBlocks = []uint32{7, 9}
+	_, dev := newTestDevice(t, config)
+	data, err := json.Marshal(dev.Report())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report map[string]interface{}
+	err = json.Unmarshal(data, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func(object map[string]interface{}) []string {
+		var names []string
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	object := func(name string) map[string]interface{} {
+		value, _ := report[name].(map[string]interface{})
+		return value
+	}
+
+	// json numbers are decoded as float64
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"keys", keys(report), []string{"bad_blocks", "chip_info", "flash_info", "id_blocks", "identity", "loader", "schema_version"}},
+		{"schema_version", report["schema_version"], float64(rkusb.ReportSchemaVersion)},
+		{"chip_info", report["chip_info"], "A213"},
+		{"bad_blocks", report["bad_blocks"], []interface{}{float64(7), float64(9)}},
+		{"id_blocks", report["id_blocks"], []interface{}{float64(2), float64(3)}},
+		{"flash_info keys", keys(object("flash_info")), []string{"access_time", "block_num", "block_size", "ecc_bits", "flash_cs", "flash_size_mb",
+			"manufacturer", "page_size", "phy_block_per_idb", "sec_num_per_idb", "sector_per_block", "valid_sec_per_block"}},
+		{"flash_info", map[string]interface{}{
+			"manufacturer":        object("flash_info")["manufacturer"],
+			"flash_size_mb":       object("flash_info")["flash_size_mb"],
+			"block_size":          object("flash_info")["block_size"],
+			"page_size":           object("flash_info")["page_size"],
+			"sector_per_block":    object("flash_info")["sector_per_block"],
+			"block_num":           object("flash_info")["block_num"],
+			"ecc_bits":            object("flash_info")["ecc_bits"],
+			"flash_cs":            object("flash_info")["flash_cs"],
+			"valid_sec_per_block": object("flash_info")["valid_sec_per_block"],
+		}, map[string]interface{}{
+			"manufacturer":        "SAMSUNG",
+			"flash_size_mb":       float64(8192),
+			"block_size":          float64(256),
+			"page_size":           float64(4),
+			"sector_per_block":    float64(512),
+			"block_num":           float64(32768),
+			"ecc_bits":            float64(40),
+			"flash_cs":            float64(1),
+			"valid_sec_per_block": float64(256),
+		}},
+		{"loader keys", keys(object("loader")), []string{"chip_tag", "fw_version", "last_loader_version", "loader_date", "loader_version",
+			"machine_id", "machine_info", "manufacturer_info", "read_write_times", "sys_reserved_block"}},
+		{"loader version", object("loader")["loader_version"], "1.01"},
+		{"loader date", object("loader")["loader_date"], "2020-01-01"},
+		{"chip tag", object("loader")["chip_tag"], "RK28"},
+		{"sys reserved block", object("loader")["sys_reserved_block"], float64(12)},
+		{"identity", object("identity"), map[string]interface{}{
+			"sn":   testSerial,
+			"imei": "N/A",
+			"uid":  "N/A",
+			"mac":  "00:00:00:00:00:00",
+			"bt":   "00:00:00:00:00:00",
+		}},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.value, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, test.value, test.want)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package rkusb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const rkBootTag = 0x544F4F42
+const rkLdrTag = 0x2052444C
+
+const (
+	Entry471    = 1
+	Entry472    = 2
+	EntryLoader = 4
+)
+
+const bootEntryNameLen = 20
+
+type RkTime struct {
+	Year   uint16
+	Month  byte
+	Day    byte
+	Hour   byte
+	Minute byte
+	Second byte
+}
+
+type RkBootHeader struct {
+	Tag           uint32
+	Size          uint16
+	Version       uint32
+	MergeVersion  uint32
+	ReleaseTime   RkTime
+	ChipType      uint32
+	Code471Num    byte
+	Code471Offset uint32
+	Code471Size   byte
+	Code472Num    byte
+	Code472Offset uint32
+	Code472Size   byte
+	LoaderNum     byte
+	LoaderOffset  uint32
+	LoaderSize    byte
+	SignFlag      byte
+	Rc4Flag       byte
+	Reserved      [57]byte
+}
+
+type RkBootEntry struct {
+	Size       byte
+	Type       uint32
+	Name       [bootEntryNameLen]uint16
+	DataOffset uint32
+	DataSize   uint32
+	DataDelay  uint32
+}
+
+type RkLoaderEntry struct {
+	Type       uint32
+	Name       string
+	DataOffset uint32
+	DataSize   uint32
+	// Delay in milliseconds to wait after the entry was sent to the device
+	DataDelay uint32
+}
+
+type RkLoader struct {
+	Header     RkBootHeader
+	Entries471 []RkLoaderEntry
+	Entries472 []RkLoaderEntry
+	// Loaders holds the entries that make up the IDB, usually FlashData and
+	// FlashBoot.
+	Loaders []RkLoaderEntry
+	Crc32   uint32
+	Size    int64
+	data    io.ReaderAt
+}
+
+// OpenLoader reads the header and all entries of a RKBOOT loader file. The
+// CRC32 at the end of the file is verified before anything else.
+func OpenLoader(file *os.File) (*RkLoader, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return &RkLoader{}, err
+	}
+
+	return ReadLoader(file, fileInfo.Size())
+}
+
+// ReadLoader parses a RKBOOT loader of the given size, e.g. the loader that is
+// embedded in an update image.
+func ReadLoader(data io.ReaderAt, size int64) (*RkLoader, error) {
+	if size < int64(binary.Size(RkBootHeader{}))+4 {
+		return &RkLoader{}, errors.New("unsupported loader format")
+	}
+
+	content := make([]byte, size)
+	n, err := data.ReadAt(content, 0)
+	if err != nil && err != io.EOF {
+		return &RkLoader{}, err
+	}
+	if int64(n) != size {
+		return &RkLoader{}, errors.New("read unexpected size from loader")
+	}
+
+	crc := binary.LittleEndian.Uint32(content[size-4:])
+	if rkCrc32(content[:size-4]) != crc {
+		return &RkLoader{}, fmt.Errorf("loader crc32: %w", ErrImageChecksum)
+	}
+
+	reader := io.NewSectionReader(data, 0, size)
+
+	header := RkBootHeader{}
+	err = binary.Read(reader, binary.LittleEndian, &header)
+	if err != nil {
+		return &RkLoader{}, err
+	}
+
+	if header.Tag != rkBootTag && header.Tag != rkLdrTag {
+		return &RkLoader{}, fmt.Errorf("loader: %w", ErrImageSignature)
+	}
+
+	entries471, err := readLoaderEntries(reader, header.Code471Offset, header.Code471Num, header.Code471Size)
+	if err != nil {
+		return &RkLoader{}, err
+	}
+
+	entries472, err := readLoaderEntries(reader, header.Code472Offset, header.Code472Num, header.Code472Size)
+	if err != nil {
+		return &RkLoader{}, err
+	}
+
+	loaders, err := readLoaderEntries(reader, header.LoaderOffset, header.LoaderNum, header.LoaderSize)
+	if err != nil {
+		return &RkLoader{}, err
+	}
+
+	return &RkLoader{
+		Header:     header,
+		Entries471: entries471,
+		Entries472: entries472,
+		Loaders:    loaders,
+		Crc32:      crc,
+		Size:       size,
+		data:       reader,
+	}, nil
+}
+
+func readLoaderEntries(reader io.ReadSeeker, offset uint32, count byte, size byte) ([]RkLoaderEntry, error) {
+	entries := make([]RkLoaderEntry, count)
+	for i := 0; i < int(count); i++ {
+		_, err := reader.Seek(int64(offset)+int64(i)*int64(size), io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := RkBootEntry{}
+		err = binary.Read(reader, binary.LittleEndian, &entry)
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i] = RkLoaderEntry{
+			Type:       entry.Type,
+			Name:       utf16ToString(entry.Name[:]),
+			DataOffset: entry.DataOffset,
+			DataSize:   entry.DataSize,
+			DataDelay:  entry.DataDelay,
+		}
+	}
+	return entries, nil
+}
+
+func utf16ToString(name []uint16) string {
+	s := ""
+	for _, c := range name {
+		if c == 0 {
+			break
+		}
+		s += string(rune(c))
+	}
+	return s
+}
+
+// EntryData reads the raw data of an entry from the loader file.
+func (loader *RkLoader) EntryData(entry RkLoaderEntry) ([]byte, error) {
+	data := make([]byte, entry.DataSize)
+	n, err := loader.data.ReadAt(data, int64(entry.DataOffset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n != int(entry.DataSize) {
+		return nil, errors.New("read unexpected size from loader")
+	}
+	return data, nil
+}
+
+// Loader returns the loader entry with the given name, e.g. FlashData or
+// FlashBoot.
+func (loader *RkLoader) Loader(name string) (RkLoaderEntry, bool) {
+	for _, entry := range loader.Loaders {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+	return RkLoaderEntry{}, false
+}
+
+// ChipName returns the chip the loader was built for, e.g. RK312A. The chip
+// type holds the four characters after "RK" in reverse byte order.
+func (loader *RkLoader) ChipName() string {
+	chip := loader.Header.ChipType
+	return "RK" + bytesToString([]byte{byte(chip >> 24), byte(chip >> 16), byte(chip >> 8), byte(chip)})
+}
+
+func (loader *RkLoader) ReleaseTime() time.Time {
+	t := loader.Header.ReleaseTime
+	return time.Date(int(t.Year), time.Month(t.Month), int(t.Day), int(t.Hour), int(t.Minute), int(t.Second), 0, time.UTC)
+}
+
+// Version returns the loader version in the major.minor format rkdeveloptool
+// prints, both parts are BCD coded.
+func (loader *RkLoader) Version() string {
+	return fmt.Sprintf("%x.%02x", (loader.Header.Version>>8)&0xFF, loader.Header.Version&0xFF)
+}
+
+// Rc4Disabled reports whether the entries are sent to the device without RC4
+// encryption.
+func (loader *RkLoader) Rc4Disabled() bool {
+	return loader.Header.Rc4Flag != 0
+}
+
+// DownloadBoot sends the 471 and 472 entries of the loader to a device in
+// Maskrom mode. The 471 entry initializes the DRAM, the 472 entry is the
+// usbplug that answers the CBW commands of RkDevice afterwards.
+func (rkDev *RkDevice) DownloadBoot(loader *RkLoader) error {
+	err := rkDev.downloadEntries(loader, loader.Entries471, 0x0471)
+	if err != nil {
+		return err
+	}
+	err = rkDev.downloadEntries(loader, loader.Entries472, 0x0472)
+	if err != nil {
+		return err
+	}
+	rkDev.mode = ModeLoader
+	return nil
+}
+
+func (rkDev *RkDevice) downloadEntries(loader *RkLoader, entries []RkLoaderEntry, code uint16) error {
+	for _, entry := range entries {
+		data, err := loader.EntryData(entry)
+		if err != nil {
+			return err
+		}
+
+		if !loader.Rc4Disabled() {
+			for offset := 0; offset < len(data); offset += SectorSize {
+				length := SectorSize
+				if offset+length > len(data) {
+					length = len(data) - offset
+				}
+				pRC4(&data, uint32(offset), uint16(length))
+			}
+		}
+
+		err = rkDev.deviceRequest(code, data)
+		if err != nil {
+			return fmt.Errorf("download of %s failed: %v", entry.Name, err)
+		}
+
+		time.Sleep(time.Duration(entry.DataDelay) * time.Millisecond)
+	}
+	return nil
+}
+
+// deviceRequest sends data followed by its CRC-CCITT with vendor control
+// transfers of at most 4096 bytes. The Maskrom code detects the end of the
+// data by a short transfer, so data that ends on a transfer boundary is
+// followed by a single zero byte.
+func (rkDev *RkDevice) deviceRequest(code uint16, data []byte) error {
+	const maxTransfer = 4096
+	sendPendPacket := false
+
+	buf := append([]byte(nil), data...)
+	switch len(data) % maxTransfer {
+	case maxTransfer - 1:
+		buf = append(buf, 0)
+	case maxTransfer - 2:
+		sendPendPacket = true
+	}
+
+	crc := CrcCcitt(buf)
+	buf = append(buf, byte(crc>>8), byte(crc))
+
+	for sent := 0; sent < len(buf); {
+		length := len(buf) - sent
+		if length > maxTransfer {
+			length = maxTransfer
+		}
+		n, err := rkDev.transport.Control(0x40, 0x0C, 0, code, buf[sent:sent+length], 0)
+		if err != nil {
+			return err
+		}
+		if n != length {
+			return errors.New("transfer size miss match")
+		}
+		sent += length
+	}
+
+	if sendPendPacket {
+		n, err := rkDev.transport.Control(0x40, 0x0C, 0, code, []byte{0}, 0)
+		if err != nil {
+			return err
+		}
+		if n != 1 {
+			return errors.New("transfer size miss match")
+		}
+	}
+	return nil
+}
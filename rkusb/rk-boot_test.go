@@ -0,0 +1,229 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"testing"
+)
+
+type testEntry struct {
+	entryType uint32
+	name      string
+	data      []byte
+}
+
+// loaderFile builds a RKBOOT file from header and the entries, the entry
+// tables and data follow the header in the order of entries.
+func loaderFile(header rkusb.RkBootHeader, entries []testEntry) []byte {
+	headerSize := uint32(binary.Size(header))
+	entrySize := uint32(binary.Size(rkusb.RkBootEntry{}))
+
+	var table []testEntry
+	offset := headerSize
+	for _, group := range []struct {
+		entryType uint32
+		num       *byte
+		offset    *uint32
+		size      *byte
+	}{
+		{rkusb.Entry471, &header.Code471Num, &header.Code471Offset, &header.Code471Size},
+		{rkusb.Entry472, &header.Code472Num, &header.Code472Offset, &header.Code472Size},
+		{rkusb.EntryLoader, &header.LoaderNum, &header.LoaderOffset, &header.LoaderSize},
+	} {
+		*group.num, *group.offset, *group.size = 0, offset, byte(entrySize)
+		for _, entry := range entries {
+			if entry.entryType == group.entryType {
+				table = append(table, entry)
+				*group.num++
+				offset += entrySize
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, header)
+	for _, entry := range table {
+		bootEntry := rkusb.RkBootEntry{Size: byte(entrySize), Type: entry.entryType, DataOffset: offset, DataSize: uint32(len(entry.data))}
+		for i, c := range []rune(entry.name) {
+			bootEntry.Name[i] = uint16(c)
+		}
+		_ = binary.Write(&buf, binary.LittleEndian, bootEntry)
+		offset += uint32(len(entry.data))
+	}
+	for _, entry := range table {
+		buf.Write(entry.data)
+	}
+	_ = binary.Write(&buf, binary.LittleEndian, rkusb.RkCrc32(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// counting returns size bytes that differ in every sector.
+func counting(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i/rkusb.SectorSize)
+	}
+	return data
+}
+
+func TestDownloadBoot(t *testing.T) {
+	// entries that end one or two bytes before, on and after a transfer
+	// boundary of 4096 bytes
+	entries := []testEntry{
+		{rkusb.Entry471, "DDR4094", counting(4094, 1)},
+		{rkusb.Entry471, "DDR4095", counting(4095, 2)},
+		{rkusb.Entry471, "DDR4096", counting(4096, 3)},
+		{rkusb.Entry471, "DDR3000", counting(3000, 4)},
+		{rkusb.Entry472, "usbplug", counting(9000, 5)},
+	}
+
+	for _, rc4Disabled := range []bool{false, true} {
+		header := rkusb.RkBootHeader{Tag: 0x544F4F42, Size: 102, Version: 0x0203, ChipType: 0x33313241}
+		if rc4Disabled {
+			header.Rc4Flag = 1
+		}
+		file := loaderFile(header, entries)
+		loader, err := rkusb.ReadLoader(bytes.NewReader(file), int64(len(file)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := emulator.DefaultConfig()
+		config.Maskrom = true
+		emu := emulator.New(config)
+		dev := rkusb.CreateRkDevice(emu)
+		if dev.Mode() != rkusb.ModeMaskrom {
+			t.Fatalf("mode %v, want Maskrom", dev.Mode())
+		}
+
+		err = dev.DownloadBoot(loader)
+		if err != nil {
+			t.Fatalf("rc4 disabled %v: %v", rc4Disabled, err)
+		}
+		if emu.InMaskrom() || dev.Mode() != rkusb.ModeLoader {
+			t.Errorf("rc4 disabled %v: device did not switch to loader mode", rc4Disabled)
+		}
+
+		received := append(emu.Downloaded(0x0471), emu.Downloaded(0x0472)...)
+		if len(received) != len(entries) {
+			t.Fatalf("rc4 disabled %v: %d entries received, want %d", rc4Disabled, len(received), len(entries))
+		}
+		for i, entry := range entries {
+			data := received[i]
+			// data one byte short of a transfer boundary is padded with a zero
+			if len(entry.data)%4096 == 4095 {
+				if data[len(data)-1] != 0 {
+					t.Errorf("%s: not padded with a zero byte", entry.name)
+				}
+				data = data[:len(data)-1]
+			}
+			if len(data) != len(entry.data) {
+				t.Errorf("%s: %d bytes received, want %d", entry.name, len(data), len(entry.data))
+				continue
+			}
+
+			// every sector of 512 bytes is encrypted on its own
+			plain := append([]byte(nil), data...)
+			if !rc4Disabled {
+				for offset := 0; offset < len(plain); offset += rkusb.SectorSize {
+					end := offset + rkusb.SectorSize
+					if end > len(plain) {
+						end = len(plain)
+					}
+					copy(plain[offset:end], rkusb.Rc4(plain[offset:end]))
+				}
+			}
+			if !bytes.Equal(plain, entry.data) {
+				t.Errorf("rc4 disabled %v: %s differs", rc4Disabled, entry.name)
+			}
+		}
+	}
+}
+
+func TestReadLoader(t *testing.T) {
+	header := rkusb.RkBootHeader{Tag: 0x544F4F42, Size: 102, Version: 0x0213, ChipType: 0x33313241}
+	header.ReleaseTime = rkusb.RkTime{Year: 2021, Month: 3, Day: 4, Hour: 5, Minute: 6, Second: 7}
+	entries := []testEntry{
+		{rkusb.Entry471, "rk3128_ddr_300MHz", counting(100, 1)},
+		{rkusb.Entry472, "usbplüg", counting(200, 2)},
+		{rkusb.EntryLoader, "FlashData", counting(300, 3)},
+		{rkusb.EntryLoader, "FlashBoot_v2.32_1234", counting(400, 4)},
+	}
+	file := loaderFile(header, entries)
+	loader, err := rkusb.ReadLoader(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loader.ChipName() != "RK312A" {
+		t.Errorf("chip %q, want RK312A", loader.ChipName())
+	}
+	if loader.Version() != "2.13" {
+		t.Errorf("version %q, want 2.13", loader.Version())
+	}
+	if got := loader.ReleaseTime().Format("2006-01-02 15:04:05"); got != "2021-03-04 05:06:07" {
+		t.Errorf("release time %s", got)
+	}
+	if loader.Rc4Disabled() {
+		t.Error("rc4 disabled")
+	}
+	if loader.Size != int64(len(file)) || loader.Crc32 != binary.LittleEndian.Uint32(file[len(file)-4:]) {
+		t.Errorf("size %d, crc32 0x%08X", loader.Size, loader.Crc32)
+	}
+	if len(loader.Entries471) != 1 || len(loader.Entries472) != 1 || len(loader.Loaders) != 2 {
+		t.Fatalf("%d 471, %d 472 and %d loader entries, want 1, 1 and 2", len(loader.Entries471), len(loader.Entries472), len(loader.Loaders))
+	}
+
+	// a name of 20 characters has no terminating zero
+	names := []string{"rk3128_ddr_300MHz", "usbplüg", "FlashData", "FlashBoot_v2.32_1234"}
+	parsed := []rkusb.RkLoaderEntry{loader.Entries471[0], loader.Entries472[0], loader.Loaders[0], loader.Loaders[1]}
+	for i, entry := range parsed {
+		if entry.Type != entries[i].entryType || entry.Name != names[i] {
+			t.Errorf("entry %d: type %d name %q, want %d %q", i, entry.Type, entry.Name, entries[i].entryType, names[i])
+		}
+		data, err := loader.EntryData(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, entries[i].data) {
+			t.Errorf("entry %s: data differs", entry.Name)
+		}
+	}
+	if _, ok := loader.Loader("FlashData"); !ok {
+		t.Error("FlashData not found")
+	}
+}
+
+func TestReadLoaderErrors(t *testing.T) {
+	header := rkusb.RkBootHeader{Tag: 0x544F4F42, Size: 102}
+	file := loaderFile(header, []testEntry{{rkusb.Entry471, "DDR", counting(100, 1)}})
+
+	badCrc := append([]byte(nil), file...)
+	badCrc[len(badCrc)-10] ^= 0xFF
+
+	header.Tag = 0x12345678
+	badTag := loaderFile(header, []testEntry{{rkusb.Entry471, "DDR", counting(100, 1)}})
+
+	tests := []struct {
+		name string
+		file []byte
+		want error
+	}{
+		{"crc", badCrc, rkusb.ErrImageChecksum},
+		{"tag", badTag, rkusb.ErrImageSignature},
+		{"short", file[:binary.Size(header)+3], nil},
+	}
+	for _, test := range tests {
+		_, err := rkusb.ReadLoader(bytes.NewReader(test.file), int64(len(test.file)))
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+			continue
+		}
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+		}
+	}
+}
@@ -1,12 +1,12 @@
-package main
+// Package rkusb implements the Rockchip USB protocol used to read and write
+// the NAND of RockChip devices, together with the update image and IDB formats.
+package rkusb
 
 import (
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/gosuri/uiprogress"
-	"github.com/gotmc/libusb"
 	"math/rand"
 	"time"
 )
@@ -40,15 +40,21 @@ const MaxTestBlocks = 512
 const IdBlockTop = 50
 
 type RkDevice struct {
-	device     *libusb.Device
-	handle     *libusb.DeviceHandle
-	bulkIn     *libusb.EndpointDescriptor
-	bulkOut    *libusb.EndpointDescriptor
+	transport  Transport
+	mode       UsbMode
+	timeouts   map[byte]time.Duration
+	retries    int
+	chipInfo   string
 	flashInfo  FlashInfo
 	blockState [64]byte
 	idb        IdB
 }
 
+// ProgressFunc is called by long running operations. The operation names the
+// current step (e.g. "write" or "validate"), name the item being processed and
+// done and total report the progress in the unit of the item, usually bytes.
+type ProgressFunc func(operation string, name string, done int, total int)
+
 type FlashInfo struct {
 	Manufacturer     string
 	FlashSize        uint
@@ -100,59 +106,39 @@ type FlashInfoCmd struct {
 	//reserved   [501]byte
 }
 
-func CreateRkDevice(dev *libusb.Device) RkDevice {
+func CreateRkDevice(transport Transport) RkDevice {
+	mode := ModeLoader
+	if reporter, ok := transport.(ModeReporter); ok {
+		mode = reporter.Mode()
+	}
 
 	return RkDevice{
-		device: dev,
+		transport: transport,
+		mode:      mode,
+		timeouts:  DefaultTimeouts,
+		retries:   DefaultRetries,
 	}
 }
 
-func (rkDev *RkDevice) Open() error {
-
-	dh, err := rkDev.device.Open()
-
-	if err != nil {
-		return err
-	}
-
-	ac, err := rkDev.device.GetActiveConfigDescriptor()
+// Mode returns the mode of the device, after DownloadBoot it is ModeLoader.
+func (rkDev *RkDevice) Mode() UsbMode {
+	return rkDev.mode
+}
 
-	if err != nil {
-		return err
-	}
+func (rkDev *RkDevice) ChipInfo() string {
+	return rkDev.chipInfo
+}
 
-	interfaces := ac.SupportedInterfaces
-	for i := 0; i < len(interfaces); i++ {
-		for j := 0; j < interfaces[i].NumAltSettings; j++ {
-			id := interfaces[i].InterfaceDescriptors[j]
-			for k := 0; k < id.NumEndpoints; k++ {
-				epd := id.EndpointDescriptors[k]
-				if epd.EndpointAddress&0x80 == 0 {
-					if rkDev.bulkOut == nil {
-						rkDev.bulkOut = epd
-					}
-				} else {
-					if rkDev.bulkIn == nil {
-						rkDev.bulkIn = epd
-					}
-				}
-				if rkDev.bulkIn != nil && rkDev.bulkOut != nil {
-					err = dh.ClaimInterface(i)
-					if err != nil {
-						return err
-					}
-					break
-				}
-			}
-		}
-	}
+func (rkDev *RkDevice) FlashInfo() FlashInfo {
+	return rkDev.flashInfo
+}
 
-	rkDev.handle = dh
-	return err
+func (rkDev *RkDevice) IdB() IdB {
+	return rkDev.idb
 }
 
 func (rkDev *RkDevice) Close() error {
-	return rkDev.handle.ReleaseInterface(0)
+	return rkDev.transport.Close()
 }
 
 func (rkDev *RkDevice) ReadDeviceData() error {
@@ -160,7 +146,7 @@ func (rkDev *RkDevice) ReadDeviceData() error {
 	if err != nil {
 		return err
 	}
-	_, err = rkDev.readChipInfo()
+	rkDev.chipInfo, err = rkDev.readChipInfo()
 	if err != nil {
 		return err
 	}
@@ -192,16 +178,66 @@ func padSize(size uint32) uint32 {
 	return size + ((512 - (size % 512)) % 512)
 }
 
-func (rkDev *RkDevice) WriteImage(rkImage *RkImage) error {
-	err := rkDev.initDeviceAsync()
+func reportProgress(progress ProgressFunc, operation string, name string, done int, total int) {
+	if progress != nil {
+		progress(operation, name, done, total)
+	}
+}
+
+// WriteImage writes the parameter file and all .img parts of the image and
+// verifies them afterwards.
+func (rkDev *RkDevice) WriteImage(rkImage *RkImage, progress ProgressFunc) error {
+	return rkDev.WriteImageParts(rkImage, PartFilter{}, progress)
+}
+
+// checkImageLayout checks the parts against the layout the device has after
+// the write, the parameter of the image when it is written and the one on the
+// device otherwise.
+func (rkDev *RkDevice) checkImageLayout(rkImage *RkImage, filter PartFilter) error {
+	var layout *Parameter
+	var err error
+	if filter.includes("parameter") {
+		layout, err = rkImage.Parameter()
+	} else {
+		layout, err = rkDev.ReadParameter()
+	}
+	if err != nil {
+		return fmt.Errorf("no layout to check the parts against: %w", err)
+	}
+	// a growing partition ends with the logical space
+	if rkDev.LogicalSectors() == 0 {
+		_, err = rkDev.readFlashInfo()
+		if err != nil {
+			return err
+		}
+	}
+	return rkImage.CheckLayout(layout, filter, rkDev.LogicalSectors())
+}
+
+// WriteImageParts writes the parameter file and the .img parts of the image
+// selected by the filter and verifies them afterwards.
+func (rkDev *RkDevice) WriteImageParts(rkImage *RkImage, filter PartFilter, progress ProgressFunc) error {
+	err := filter.check(rkImage)
+	if err != nil {
+		return err
+	}
+
+	err = rkDev.initDeviceAsync()
 	if err != nil {
 		return err
 	}
 
-	var totalSize = 0
+	if !filter.NoLayoutCheck {
+		err = rkDev.checkImageLayout(rkImage, filter)
+		if err != nil {
+			return err
+		}
+	}
+
+	var parts []RkImagePart
 	for _, part := range rkImage.ImageParts {
-		if bytes.HasSuffix([]byte(part.File), []byte(".img")) {
-			totalSize += int(part.Size)
+		if bytes.HasSuffix([]byte(part.File), []byte(".img")) && filter.includes(part.Name) {
+			parts = append(parts, part)
 		}
 	}
 
@@ -214,17 +250,14 @@ func (rkDev *RkDevice) WriteImage(rkImage *RkImage) error {
 		}
 	}
 
-	if parameter == nil {
+	if parameter == nil && filter.includes("parameter") {
 		return errors.New("no parameters found in image file")
 	}
+	if !filter.includes("parameter") {
+		parameter = nil
+	}
 
-	uiprogress.Start()
-	defer uiprogress.Stop()
-
-	{
-		barWriteParameter := uiprogress.AddBar(0x1c00).PrependFunc(func(b *uiprogress.Bar) string {
-			return "   write:  parameter"
-		}).AppendCompleted()
+	if parameter != nil {
 		// Write parameter file
 		var parameterBytes = make([]byte, parameter.Size)
 
@@ -244,29 +277,14 @@ func (rkDev *RkDevice) WriteImage(rkImage *RkImage) error {
 			parameterBytes = tmp
 		}
 
-		totalSize += 8 * len(parameterBytes)
-
-		var addr uint32 = 0x0000
-		for ; addr <= 0x1c00; addr += 0x0400 {
-			err := rkDev.writeLba(addr, parameterBytes, 0)
-			if err != nil {
-				return err
-			}
-			barWriteParameter.Set(int(addr))
+		err = rkDev.writeParameterCopies(parameter.Name, parameterBytes, progress)
+		if err != nil {
+			return err
 		}
-		barWriteParameter.Set(0x1c00)
 	}
 
 	// flash image partitions
-	for _, part := range rkImage.ImageParts {
-		if !bytes.HasSuffix([]byte(part.File), []byte(".img")) {
-			continue
-		}
-
-		pn := fmt.Sprintf("   write: %10s", part.Name)
-		barWritePart := uiprogress.AddBar(int(part.Size)).PrependFunc(func(b *uiprogress.Bar) string {
-			return pn
-		}).AppendCompleted()
+	for _, part := range parts {
 
 		var reserved byte = 0
 		if part.Name == "system" {
@@ -304,16 +322,13 @@ func (rkDev *RkDevice) WriteImage(rkImage *RkImage) error {
 				return err
 			}
 			partPos += len(data)
-			barWritePart.Set(partPos)
+			reportProgress(progress, "write", part.Name, partPos, int(part.Size))
 		}
-		barWritePart.Set(int(part.Size))
+		reportProgress(progress, "write", part.Name, int(part.Size), int(part.Size))
 	}
 
 	// verify
-	{
-		barReadParameter := uiprogress.AddBar(0x1c00).PrependFunc(func(b *uiprogress.Bar) string {
-			return "validate:  parameter"
-		}).AppendCompleted()
+	if parameter != nil {
 		var parameterBytes = make([]byte, parameter.Size)
 
 		n, error := rkImage.File.ReadAt(parameterBytes, int64(parameter.Pos))
@@ -332,32 +347,13 @@ func (rkDev *RkDevice) WriteImage(rkImage *RkImage) error {
 			parameterBytes = tmp
 		}
 
-		totalSize += 8 * len(parameterBytes)
-
-		var addr uint32 = 0
-		for ; addr <= 0x1c00; addr += 0x0400 {
-			data, err := rkDev.readLba(addr, uint(len(parameterBytes)), 0)
-			if err != nil {
-				return err
-			}
-			if !bytes.Equal(data, parameterBytes) {
-				return errors.New("check image error")
-			}
-
-			barReadParameter.Set(int(addr))
+		err := rkDev.verifyParameterCopies(parameter.Name, parameterBytes, progress)
+		if err != nil {
+			return err
 		}
-		barReadParameter.Set(0x1c00)
 	}
 
-	for _, part := range rkImage.ImageParts {
-		if !bytes.HasSuffix([]byte(part.File), []byte(".img")) {
-			continue
-		}
-
-		pn := fmt.Sprintf("validate: %10s", part.Name)
-		barReadPart := uiprogress.AddBar(int(part.Size)).PrependFunc(func(b *uiprogress.Bar) string {
-			return pn
-		}).AppendCompleted()
+	for _, part := range parts {
 
 		var reserved byte = 0
 		if part.Name == "system" {
@@ -395,13 +391,13 @@ func (rkDev *RkDevice) WriteImage(rkImage *RkImage) error {
 				return err
 			}
 			if !bytes.Equal(data, deviceData) {
-				return errors.New("check image error")
+				return &ErrVerifyMismatch{part.Name, part.NandAddr + addr}
 			}
 
 			partPos += len(data)
-			barReadPart.Set(partPos)
+			reportProgress(progress, "validate", part.Name, partPos, int(part.Size))
 		}
-		barReadPart.Set(int(part.Size))
+		reportProgress(progress, "validate", part.Name, int(part.Size), int(part.Size))
 	}
 	return nil
 }
@@ -472,7 +468,7 @@ func (rkDev *RkDevice) readFlashInfo() (FlashInfo, error) {
 	fi := FlashInfo{
 		Manufacturer:     manufacturerName,
 		FlashSize:        uint(fiCmd.FlashSize / 1024),
-		BlockNum:         uint(fiCmd.FlashSize) * 1024 / uint(fiCmd.BlockSize),
+		BlockNum:         uint(fiCmd.FlashSize) / uint(fiCmd.BlockSize),
 		BlockSize:        uint(fiCmd.BlockSize / 2),
 		PageSize:         fiCmd.PageSize / 2,
 		SectorPerBlock:   uint(fiCmd.BlockSize),
@@ -554,7 +550,38 @@ func (rkDev *RkDevice) writeLba(addr uint32, data []byte, reserved byte) error {
 	return err
 }
 
+// sendCbw sends the command and returns the data the device answered with.
+// A command that fails with a transfer error is repeated with a new tag after
+// the endpoints were recovered.
 func (rkDev *RkDevice) sendCbw(cbw cbw, extra []byte) ([]byte, error) {
+	// the boot ROM and MSC mode do not understand the loader commands
+	switch rkDev.mode {
+	case ModeMaskrom:
+		return nil, ErrMaskromMode
+	case ModeMsc:
+		return nil, ErrMscMode
+	}
+
+	for attempt := 0; ; attempt++ {
+		data, err := rkDev.transferCbw(cbw, extra)
+		// only reads are repeated, a write, erase or reset may have taken
+		// effect before the transfer failed
+		_, transferErr := err.(*TransferError)
+		if !transferErr || attempt >= rkDev.retries || cbw.flags != DirectionIn {
+			return data, err
+		}
+		// without clean endpoints a repeated command fails as well
+		recoverErr := rkDev.recoverEndpoints()
+		if recoverErr != nil {
+			return data, fmt.Errorf("%w, %v", err, recoverErr)
+		}
+		cbw.tag = rand.Uint32()
+	}
+}
+
+// transferCbw runs the command once: CBW out, data out or in and the CSW.
+func (rkDev *RkDevice) transferCbw(cbw cbw, extra []byte) ([]byte, error) {
+	timeout := rkDev.timeouts[cbw.cbwcb.opCode]
 
 	var buf bytes.Buffer
 	err := binary.Write(&buf, binary.BigEndian, cbw)
@@ -562,21 +589,21 @@ func (rkDev *RkDevice) sendCbw(cbw cbw, extra []byte) ([]byte, error) {
 		return nil, err
 	}
 	var data = buf.Bytes()
-	n, err := rkDev.handle.BulkTransferOut(rkDev.bulkOut.EndpointAddress, data, 0)
+	n, err := rkDev.transport.BulkOut(data, timeout)
 	if err != nil {
-		return nil, err
+		return nil, &TransferError{PhaseCbwOut, cbw.cbwcb.opCode, err}
 	}
 	if n != buf.Len() {
-		return nil, errors.New("transfer size miss match")
+		return nil, &TransferError{PhaseCbwOut, cbw.cbwcb.opCode, errors.New("transfer size miss match")}
 	}
 
 	if extra != nil {
-		n, err := rkDev.handle.BulkTransferOut(rkDev.bulkOut.EndpointAddress, extra, 0)
+		n, err := rkDev.transport.BulkOut(extra, timeout)
 		if err != nil {
-			return nil, err
+			return nil, &TransferError{PhaseDataOut, cbw.cbwcb.opCode, err}
 		}
 		if n != len(extra) {
-			return nil, errors.New("transfer size miss match")
+			return nil, &TransferError{PhaseDataOut, cbw.cbwcb.opCode, errors.New("transfer size miss match")}
 		}
 	}
 
@@ -584,11 +611,16 @@ func (rkDev *RkDevice) sendCbw(cbw cbw, extra []byte) ([]byte, error) {
 	var cswBuf bytes.Buffer
 
 	for true {
-		data, n, err := rkDev.handle.BulkTransferIn(rkDev.bulkIn.EndpointAddress, 1024, 0)
+		data, err := rkDev.transport.BulkIn(1024, timeout)
 
 		if err != nil {
-			break
+			phase := PhaseCsw
+			if inBuf.Len() < expectedIn(cbw) {
+				phase = PhaseDataIn
+			}
+			return nil, &TransferError{phase, cbw.cbwcb.opCode, err}
 		}
+		n := len(data)
 
 		if n == 13 && data[0] == 0x55 && data[1] == 0x53 && data[2] == 0x42 && data[3] == 0x53 {
 			cswBuf.Write(data[0:13])
@@ -602,20 +634,19 @@ func (rkDev *RkDevice) sendCbw(cbw cbw, extra []byte) ([]byte, error) {
 
 	csw := Csw{}
 	if cswBuf.Len() < binary.Size(csw) {
-		return nil, errors.New("IO error")
+		return nil, &TransferError{PhaseCsw, cbw.cbwcb.opCode, fmt.Errorf("short CSW of %d bytes", cswBuf.Len())}
 	}
-
 	err = binary.Read(&cswBuf, binary.BigEndian, &csw)
 	if err != nil {
 		return nil, err
 	}
 
 	if csw.Signature != CswSign || csw.Tag != cbw.tag {
-		return nil, errors.New("ufi check failed")
+		return nil, fmt.Errorf("command 0x%02X: %w", cbw.cbwcb.opCode, ErrCswMismatch)
 	}
 
 	if csw.Status == 1 {
-		return nil, errors.New("communication error")
+		return nil, fmt.Errorf("command 0x%02X: %w", cbw.cbwcb.opCode, ErrDeviceStatus)
 	}
 
 	return inBuf.Bytes(), nil
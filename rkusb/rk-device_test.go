@@ -0,0 +1,289 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"rockchipr/rkusb"
+	"rockchipr/rkusb/emulator"
+	"testing"
+	"time"
+)
+
+const testSerial = "TEST0123"
+
+// newTestDevice returns an emulator with an IDB in blocks 2 and 3 and a
+// device on top of it, ReadDeviceData was already called.
+func newTestDevice(t *testing.T, config emulator.Config) (*emulator.Emulator, *rkusb.RkDevice) {
+	t.Helper()
+	emu := emulator.New(config)
+
+	var sec3 rkusb.RkAndroidIdBSec3
+	sec3.SnSize = uint16(len(testSerial))
+	copy(sec3.Sn[:], testSerial)
+	data, err := emulator.IdBlockData([]uint16{2, 3}, sec3, 4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range []uint32{2, 3} {
+		err = emu.WriteIdBlock(block, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dev := rkusb.CreateRkDevice(emu)
+	err = dev.ReadDeviceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return emu, &dev
+}
+
+type testPart struct {
+	name string
+	file string
+	addr uint32
+	data []byte
+}
+
+// writeTestImage writes an update image with the parts to dir and opens it.
+func writeTestImage(t *testing.T, dir string, parts []testPart) *rkusb.RkImage {
+	t.Helper()
+	header := rkusb.RkImageHeader{Tag: 0x46414B52, ItemCount: int32(len(parts))}
+	copy(header.MachineModel[:], "TEST")
+	headerSize := (uint32(binary.Size(header)) + 511) / 512 * 512
+
+	var body bytes.Buffer
+	pos := headerSize
+	for i, part := range parts {
+		item := &header.Item[i]
+		copy(item.Name[:], part.name)
+		copy(item.File[:], part.file)
+		item.NandAddr = part.addr
+		item.Pos = pos
+		item.Size = uint32(len(part.data))
+		item.PaddedSize = (item.Size + 511) / 512 * 512
+		padded := make([]byte, item.PaddedSize)
+		copy(padded, part.data)
+		body.Write(padded)
+		pos += item.PaddedSize
+	}
+
+	var firmware bytes.Buffer
+	_ = binary.Write(&firmware, binary.LittleEndian, header)
+	firmware.Write(make([]byte, int(headerSize)-firmware.Len()))
+	firmware.Write(body.Bytes())
+
+	const fwOffset = 0x66
+	image := make([]byte, fwOffset)
+	binary.LittleEndian.PutUint32(image, 0x57464B52)
+	binary.LittleEndian.PutUint32(image[0x21:], fwOffset)
+	binary.LittleEndian.PutUint32(image[0x25:], uint32(firmware.Len()))
+	image = append(image, firmware.Bytes()...)
+	image = append(image, md5Hex(image)...)
+
+	path := filepath.Join(dir, "update.img")
+	err := ioutil.WriteFile(path, image, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rkImage, err := rkusb.OpenImage(file)
+	if err != nil {
+		file.Close()
+		t.Fatal(err)
+	}
+	return rkImage
+}
+
+func md5Hex(data []byte) []byte {
+	sum := md5.Sum(data)
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+func parameterBlob(t *testing.T, text string) []byte {
+	t.Helper()
+	p, err := rkusb.ParseParameter([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := p.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rkusb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestReadDeviceData(t *testing.T) {
+	_, dev := newTestDevice(t, emulator.DefaultConfig())
+
+	report := dev.Report()
+	if report.ChipInfo != "A213" {
+		t.Errorf("chip info %q, want A213", report.ChipInfo)
+	}
+	if dev.LogicalSectors() != 0x1000000 {
+		t.Errorf("logical sectors 0x%X, want 0x1000000", dev.LogicalSectors())
+	}
+	if len(report.IdBlocks) != 2 || report.IdBlocks[0] != 2 || report.IdBlocks[1] != 3 {
+		t.Errorf("id blocks %v, want [2 3]", report.IdBlocks)
+	}
+	if dev.GetSerialNo() != testSerial {
+		t.Errorf("serial %q, want %q", dev.GetSerialNo(), testSerial)
+	}
+}
+
+func TestWriteDeviceData(t *testing.T) {
+	emu, dev := newTestDevice(t, emulator.DefaultConfig())
+
+	err := dev.SetSerialNo("NEW-SERIAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dev.WriteDeviceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := rkusb.CreateRkDevice(emu)
+	err = reopened.ReadDeviceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.GetSerialNo() != "NEW-SERIAL" {
+		t.Errorf("serial %q after write, want NEW-SERIAL", reopened.GetSerialNo())
+	}
+	if reopened.IdB().OldSec1.ReadWriteTimes != 1 {
+		t.Errorf("read write times %d, want 1", reopened.IdB().OldSec1.ReadWriteTimes)
+	}
+}
+
+func TestWriteImage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	param := parameterBlob(t, "CMDLINE:mtdparts=rk29xxnand:0x00002000@0x00002000(misc),0x00008000@0x00004000(boot),-@0x0000c000(userdata)\n")
+	misc := bytes.Repeat([]byte{0x11}, 4096)
+	boot := bytes.Repeat([]byte{0x22}, 3000)
+	rkImage := writeTestImage(t, dir, []testPart{
+		{"parameter", "parameter", 0, param},
+		{"misc", "Image/misc.img", 0x2000, misc},
+		{"boot", "Image/boot.img", 0x4000, boot},
+	})
+	defer rkImage.File.Close()
+
+	emu, dev := newTestDevice(t, emulator.DefaultConfig())
+	err := dev.WriteImage(rkImage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for lba := uint32(0); lba < 0x2000; lba += 0x400 {
+		if got := emu.ReadLba(lba, 1); !bytes.Equal(got[:len(param)], param) {
+			t.Errorf("parameter copy at lba 0x%X differs", lba)
+		}
+	}
+	if got := emu.ReadLba(0x2000, 8); !bytes.Equal(got, misc) {
+		t.Error("misc differs")
+	}
+	if got := emu.ReadLba(0x4000, 6); !bytes.Equal(got[:len(boot)], boot) {
+		t.Error("boot differs")
+	}
+}
+
+// cswResponder answers every CBW sent to the MemoryTransport with a CSW that
+// carries its tag, the payload of data out commands is accepted as is.
+type cswResponder struct {
+	*rkusb.MemoryTransport
+	tag     []byte
+	pending int
+}
+
+func (r *cswResponder) BulkOut(data []byte, timeout time.Duration) (int, error) {
+	n, err := r.MemoryTransport.BulkOut(data, timeout)
+	if err != nil {
+		return n, err
+	}
+	if r.pending > 0 {
+		r.pending -= len(data)
+	} else if len(data) == 31 && binary.BigEndian.Uint32(data) == rkusb.CbwSign {
+		r.tag = append([]byte(nil), data[4:8]...)
+		if data[15] == rkusb.WriteLba {
+			r.pending = int(binary.BigEndian.Uint16(data[22:24])) * 512
+		}
+	}
+	if r.pending <= 0 && r.tag != nil {
+		csw := make([]byte, 13)
+		binary.BigEndian.PutUint32(csw, rkusb.CswSign)
+		copy(csw[4:8], r.tag)
+		r.QueueIn(csw)
+		r.tag = nil
+	}
+	return n, nil
+}
+
+func TestWriteLbaMemoryTransport(t *testing.T) {
+	transport := &cswResponder{MemoryTransport: rkusb.NewMemoryTransport()}
+	dev := rkusb.CreateRkDevice(transport)
+
+	data := bytes.Repeat([]byte{0x5A}, 0x900*512)
+	err := dev.WriteLba(0x100, bytes.NewReader(data), int64(len(data)), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two test unit ready, then two chunks of CBW and data
+	out := transport.Out()
+	if len(out) != 6 {
+		t.Fatalf("%d bulk out transfers, want 6", len(out))
+	}
+	chunks := []struct {
+		lba    uint32
+		length uint16
+	}{{0x100, 0x800}, {0x900, 0x100}}
+	for i, chunk := range chunks {
+		cbw := out[2+2*i]
+		if cbw[15] != rkusb.WriteLba {
+			t.Errorf("chunk %d: opcode 0x%02X", i, cbw[15])
+		}
+		if lba := binary.BigEndian.Uint32(cbw[17:21]); lba != chunk.lba {
+			t.Errorf("chunk %d: lba 0x%X, want 0x%X", i, lba, chunk.lba)
+		}
+		if length := binary.BigEndian.Uint16(cbw[22:24]); length != chunk.length {
+			t.Errorf("chunk %d: length 0x%X, want 0x%X", i, length, chunk.length)
+		}
+		if len(out[3+2*i]) != int(chunk.length)*512 {
+			t.Errorf("chunk %d: %d data bytes", i, len(out[3+2*i]))
+		}
+	}
+}
+
+func TestCswMismatch(t *testing.T) {
+	transport := rkusb.NewMemoryTransport()
+	csw := make([]byte, 13)
+	binary.BigEndian.PutUint32(csw, rkusb.CswSign)
+	transport.QueueIn(csw)
+	dev := rkusb.CreateRkDevice(transport)
+
+	err := dev.ReadLba(0, 1, ioutil.Discard, 0, nil)
+	if !errors.Is(err, rkusb.ErrCswMismatch) {
+		t.Errorf("got %v, want ErrCswMismatch", err)
+	}
+}
@@ -1,10 +1,9 @@
-package main
+package rkusb
 
 import (
 	"bytes"
 	"crypto/md5"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"os"
 )
@@ -46,45 +45,72 @@ type RkImagePart struct {
 	// sub stream
 }
 
+// RkFwHeader is the start of an update image, it locates the loader and the
+// RKAF firmware.
+type RkFwHeader struct {
+	Tag          uint32
+	HeaderSize   uint16
+	Version      uint32
+	Code         uint32
+	Year         uint16
+	Month        byte
+	Day          byte
+	Hour         byte
+	Minute       byte
+	Second       byte
+	Chip         uint32
+	LoaderOffset uint32
+	LoaderSize   uint32
+	FwOffset     uint32
+	FwSize       uint32
+}
+
 type RkImage struct {
 	FwOffset    uint32
 	FwSize      uint32
+	FwHeader    RkFwHeader
 	ImageHeader RkImageHeader
 	ImageParts  []RkImagePart
 	File        *os.File
 }
 
-func Open(file *os.File) (*RkImage, error) {
-	err := checkMd5(file)
-
-	if err != nil {
-		return &RkImage{}, err
-	}
-	fmt.Println("md5 checksum: OK")
-
+// OpenImage reads the RKFW header and the partition table of an update image.
+// The signature and the md5 checksum at the end of the file are verified
+// before anything else.
+func OpenImage(file *os.File) (*RkImage, error) {
 	var buf = make([]byte, 512)
 
 	n, err := file.ReadAt(buf, 0)
 
+	if n != 512 {
+		return &RkImage{}, fmt.Errorf("image shorter than its header: %w", ErrImageSignature)
+	}
+
 	if err != nil {
 		return &RkImage{}, err
 	}
 
-	if n != 512 {
-		return &RkImage{}, errors.New("unsupported image format")
+	if binary.LittleEndian.Uint32(buf) != 0x57464B52 {
+		return &RkImage{}, fmt.Errorf("no RKFW tag: %w", ErrImageSignature)
 	}
 
-	if binary.LittleEndian.Uint32(buf) != 0x57464B52 {
-		return &RkImage{}, errors.New("unexpected image signature")
+	err = checkMd5(file)
+
+	if err != nil {
+		return &RkImage{}, err
 	}
 
-	test := buf[0x21 : 0x21+4]
-	fwOffset := binary.LittleEndian.Uint32(test)
-	fwSize := binary.LittleEndian.Uint32(buf[0x25:])
+	fwHeader := RkFwHeader{}
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, &fwHeader)
+	if err != nil {
+		return &RkImage{}, err
+	}
+	fwOffset := fwHeader.FwOffset
+	fwSize := fwHeader.FwSize
 
 	hdr, err := readImageHeader(file, int64(fwOffset))
 	if err != nil {
-		return &RkImage{}, nil
+		return &RkImage{}, err
 	}
 
 	parts := make([]RkImagePart, hdr.ItemCount)
@@ -94,10 +120,12 @@ func Open(file *os.File) (*RkImage, error) {
 	}
 
 	return &RkImage{
-		FwOffset:   fwOffset,
-		FwSize:     fwSize,
-		ImageParts: parts,
-		File:       file,
+		FwOffset:    fwOffset,
+		FwSize:      fwSize,
+		FwHeader:    fwHeader,
+		ImageHeader: hdr,
+		ImageParts:  parts,
+		File:        file,
 	}, nil
 }
 
@@ -115,7 +143,7 @@ func readImageHeader(file *os.File, offset int64) (RkImageHeader, error) {
 	}
 
 	if header.Tag != rkImageTag {
-		return header, errors.New("RK image tag does not match")
+		return header, fmt.Errorf("no RKAF tag at 0x%08X: %w", offset, ErrImageSignature)
 	}
 
 	return header, nil
@@ -126,6 +154,7 @@ func convertRkImageItemToPart(item RkImageItem, fwOffset uint32) RkImagePart {
 	return RkImagePart{
 		Name:        name,
 		File:        bytesToString(bytes.Split(item.File[:], []byte{0})[0]),
+		NandSize:    item.NandSize,
 		NandAddr:    item.NandAddr,
 		Pos:         item.Pos + fwOffset,
 		PaddedSize:  item.PaddedSize,
@@ -167,7 +196,7 @@ func checkMd5(file *os.File) error {
 			return err
 		}
 		if n != 512 {
-			return errors.New("checksum failed")
+			return fmt.Errorf("short read: %w", ErrImageChecksum)
 		}
 		checkSize -= 512
 		hash.Write(buff)
@@ -203,7 +232,7 @@ func checkMd5(file *os.File) error {
 		for j := 0; j < 16; j++ {
 			if tmp[j][1] == s[i/2]>>4 {
 				if md5Signature[i] != tmp[j][0] {
-					return errors.New("md5 check error 1")
+					return fmt.Errorf("md5: %w", ErrImageChecksum)
 				}
 			}
 
@@ -212,7 +241,7 @@ func checkMd5(file *os.File) error {
 			}
 
 			if md5Signature[i+1] != tmp[j][0] {
-				return errors.New("md5 check error 2")
+				return fmt.Errorf("md5: %w", ErrImageChecksum)
 			}
 		}
 	}
@@ -0,0 +1,114 @@
+package rkusb
+
+import (
+	"fmt"
+	"time"
+)
+
+// TransferPhase is the part of a CBW command a transfer belongs to.
+type TransferPhase int
+
+const (
+	PhaseCbwOut TransferPhase = iota
+	PhaseDataOut
+	PhaseDataIn
+	PhaseCsw
+)
+
+func (phase TransferPhase) String() string {
+	switch phase {
+	case PhaseCbwOut:
+		return "cbw out"
+	case PhaseDataOut:
+		return "data out"
+	case PhaseDataIn:
+		return "data in"
+	case PhaseCsw:
+		return "csw"
+	}
+	return "unknown"
+}
+
+// TransferError is returned when a USB transfer of a command fails, Err is
+// the error of the transport.
+type TransferError struct {
+	Phase  TransferPhase
+	OpCode byte
+	Err    error
+}
+
+func (e *TransferError) Error() string {
+	return fmt.Sprintf("%s of command 0x%02X failed: %v", e.Phase, e.OpCode, e.Err)
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultTimeouts is the timeout of every transfer of a command, erasing and
+// writing the NAND take much longer than the info commands.
+var DefaultTimeouts = map[byte]time.Duration{
+	TestUnitReady: 5 * time.Second,
+	TestBadBlock:  20 * time.Second,
+	ReadSector:    10 * time.Second,
+	WriteSector:   10 * time.Second,
+	EraseNormal:   20 * time.Second,
+	ReadLba:       20 * time.Second,
+	WriteLba:      20 * time.Second,
+	ReadFlashInfo: 5 * time.Second,
+	ReadChipInfo:  5 * time.Second,
+	DeviceReset:   5 * time.Second,
+}
+
+// DefaultRetries is how often a command is repeated after a transfer error.
+const DefaultRetries = 3
+
+// SetTimeout sets the timeout of every transfer of the command with opCode,
+// 0 waits forever.
+func (rkDev *RkDevice) SetTimeout(opCode byte, timeout time.Duration) {
+	timeouts := make(map[byte]time.Duration, len(rkDev.timeouts)+1)
+	for code, t := range rkDev.timeouts {
+		timeouts[code] = t
+	}
+	timeouts[opCode] = timeout
+	rkDev.timeouts = timeouts
+}
+
+// SetRetries sets how often a command is repeated after a transfer error.
+// Only commands that read from the device are repeated, a write may already
+// have reached the NAND in part. Failures reported by the device in the CSW
+// are never repeated.
+func (rkDev *RkDevice) SetRetries(retries int) {
+	rkDev.retries = retries
+}
+
+// recoverEndpoints clears a stall of both bulk endpoints, if the transport
+// supports it, so the next command starts from a clean state.
+func (rkDev *RkDevice) recoverEndpoints() error {
+	resetter, ok := rkDev.transport.(EndpointResetter)
+	if !ok {
+		return nil
+	}
+	err := resetter.ResetEndpoints()
+	if err != nil {
+		return fmt.Errorf("resetting endpoints: %w", err)
+	}
+	return nil
+}
+
+// expectedIn returns the number of data bytes the device sends before the
+// CSW, for commands with a data phase of unknown size it is 1.
+func expectedIn(cbw cbw) int {
+	if cbw.flags != DirectionIn {
+		return 0
+	}
+	switch cbw.cbwcb.opCode {
+	case TestUnitReady:
+		return 0
+	case ReadLba:
+		return int(cbw.cbwcb.length) * SectorSize
+	case ReadSector:
+		return int(cbw.cbwcb.length) * PhysicalSectorSize
+	}
+	return 1
+}
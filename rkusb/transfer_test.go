@@ -0,0 +1,96 @@
+package rkusb_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"rockchipr/rkusb"
+	"strings"
+	"testing"
+	"time"
+)
+
+// haltTransport is a MemoryTransport that can reset stalled endpoints.
+type haltTransport struct {
+	*rkusb.MemoryTransport
+	resets   int
+	resetErr error
+}
+
+func (t *haltTransport) ResetEndpoints() error {
+	t.resets++
+	return t.resetErr
+}
+
+func TestRetryRecoversEndpoints(t *testing.T) {
+	transport := &haltTransport{MemoryTransport: rkusb.NewMemoryTransport()}
+	dev := rkusb.CreateRkDevice(transport)
+
+	// no bulk in data is queued, every attempt fails in the CSW phase
+	err := dev.ReadLba(0, 1, ioutil.Discard, 0, nil)
+	var transferErr *rkusb.TransferError
+	if !errors.As(err, &transferErr) || transferErr.Phase != rkusb.PhaseCsw {
+		t.Fatalf("got %v, want a CSW transfer error", err)
+	}
+	if attempts := len(transport.Out()); attempts != rkusb.DefaultRetries+1 {
+		t.Errorf("%d attempts, want %d", attempts, rkusb.DefaultRetries+1)
+	}
+	if transport.resets != rkusb.DefaultRetries {
+		t.Errorf("%d endpoint resets, want %d", transport.resets, rkusb.DefaultRetries)
+	}
+}
+
+func TestRetryStopsWhenRecoveryFails(t *testing.T) {
+	resetErr := errors.New("pipe error")
+	transport := &haltTransport{MemoryTransport: rkusb.NewMemoryTransport(), resetErr: resetErr}
+	dev := rkusb.CreateRkDevice(transport)
+
+	err := dev.ReadLba(0, 1, ioutil.Discard, 0, nil)
+	var transferErr *rkusb.TransferError
+	if !errors.As(err, &transferErr) {
+		t.Fatalf("got %v, want the transfer error", err)
+	}
+	if !strings.Contains(err.Error(), "resetting endpoints: pipe error") {
+		t.Errorf("error %q does not mention the recovery", err)
+	}
+	if attempts := len(transport.Out()); attempts != 1 {
+		t.Errorf("%d attempts, want 1", attempts)
+	}
+}
+
+// lostCswTransport answers every command but WriteLba, whose CSW gets lost.
+type lostCswTransport struct {
+	*cswResponder
+	resets int
+}
+
+func (t *lostCswTransport) BulkOut(data []byte, timeout time.Duration) (int, error) {
+	if len(data) == 31 && data[15] == rkusb.WriteLba {
+		return t.MemoryTransport.BulkOut(data, timeout)
+	}
+	return t.cswResponder.BulkOut(data, timeout)
+}
+
+func (t *lostCswTransport) ResetEndpoints() error {
+	t.resets++
+	return nil
+}
+
+func TestWritesAreNotRetried(t *testing.T) {
+	transport := &lostCswTransport{cswResponder: &cswResponder{MemoryTransport: rkusb.NewMemoryTransport()}}
+	dev := rkusb.CreateRkDevice(transport)
+
+	// the data may have reached the NAND before the CSW got lost
+	err := dev.WriteLba(0, bytes.NewReader(make([]byte, 512)), 512, 0, nil)
+	var transferErr *rkusb.TransferError
+	if !errors.As(err, &transferErr) || transferErr.Phase != rkusb.PhaseCsw {
+		t.Fatalf("got %v, want a CSW transfer error", err)
+	}
+	// two test unit ready, then the CBW and the data of a single attempt
+	if attempts := len(transport.Out()); attempts != 4 {
+		t.Errorf("%d bulk out transfers, want 4", attempts)
+	}
+	if transport.resets != 0 {
+		t.Errorf("%d endpoint resets, want 0", transport.resets)
+	}
+}
@@ -0,0 +1,34 @@
+package rkusb
+
+import "time"
+
+// Transport moves the raw USB transfers of the Rockchip protocol. RkDevice
+// only talks to the device through a Transport, so the protocol can run on top
+// of libusb as well as on top of an in-memory or emulated device.
+//
+// A timeout of 0 waits forever.
+type Transport interface {
+	// BulkOut sends data to the bulk out endpoint and returns the number
+	// of bytes transferred.
+	BulkOut(data []byte, timeout time.Duration) (int, error)
+	// BulkIn receives up to maxLength bytes from the bulk in endpoint.
+	BulkIn(maxLength int, timeout time.Duration) ([]byte, error)
+	// Control performs a control transfer on endpoint 0. For device to host
+	// requests the answer is written to data.
+	Control(requestType byte, request byte, value uint16, index uint16, data []byte, timeout time.Duration) (int, error)
+	Close() error
+}
+
+// ModeReporter is implemented by transports that know the mode the device
+// was enumerated in. Devices behind other transports are expected to run a
+// loader.
+type ModeReporter interface {
+	Mode() UsbMode
+}
+
+// EndpointResetter is implemented by transports that can clear stalled bulk
+// endpoints including the data toggle of the host. sendCbw uses it to recover
+// before it repeats a failed command.
+type EndpointResetter interface {
+	ResetEndpoints() error
+}
@@ -0,0 +1,118 @@
+package rkusb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// UpgradeLoader replaces the IDB with a new one built from the FlashData and
+// FlashBoot entries of the loader, like the ul command of rkdeveloptool. Every
+// ID block found on the device is rewritten, the disk layout and machine info
+// of sec1 and the identity data of sec3 are kept. ReadDeviceData has to be
+// called before.
+func (rkDev *RkDevice) UpgradeLoader(loader *RkLoader) error {
+	if rkDev.idb.oldIdBCount == 0 {
+		return fmt.Errorf("upgrade loader: %w", ErrNoIdBlock)
+	}
+
+	blocks := rkDev.idb.idBlockOffset[0:rkDev.idb.oldIdBCount]
+	return rkDev.writeNewIdB(loader, blocks, rkDev.idb.OldSec3)
+}
+
+// loaderEntryData returns the data of a loader entry padded to whole pages
+// of 2048 bytes.
+func loaderEntryData(loader *RkLoader, name string) ([]byte, error) {
+	entry, ok := loader.Loader(name)
+	if !ok {
+		return nil, fmt.Errorf("loader entry %s not found", name)
+	}
+	data, err := loader.EntryData(entry)
+	if err != nil {
+		return nil, err
+	}
+	const pageSize = 2048
+	if len(data)%pageSize != 0 {
+		data = append(data, make([]byte, pageSize-len(data)%pageSize)...)
+	}
+	return data, nil
+}
+
+// encodeBootSectors converts 512 byte sectors into physical 528 byte sectors
+// with zero spare bytes and the BCH code.
+func encodeBootSectors(data []byte) []byte {
+	var outBuffer bytes.Buffer
+	sector := make([]byte, SectorSize+3)
+	for offset := 0; offset < len(data); offset += SectorSize {
+		copy(sector, data[offset:offset+SectorSize])
+		encoded := bchEncode(sector)
+		outBuffer.Write(encoded[:])
+	}
+	return outBuffer.Bytes()
+}
+
+// writeIdBlocks erases every block and writes data, physical sectors of 528
+// bytes, to its start. The data part of every sector is read back and
+// compared.
+func (rkDev *RkDevice) writeIdBlocks(data []byte, blocks []uint) error {
+	sectors := uint(len(data) / PhysicalSectorSize)
+	if sectors > rkDev.flashInfo.SectorPerBlock {
+		return errors.New("id block data exceeds the block size")
+	}
+
+	for _, block := range blocks {
+		err := rkDev.eraseNormal(uint32(block), 1)
+		if err != nil {
+			return err
+		}
+
+		var i uint
+		for i = 0; i < sectors; i += 0x10 {
+			var length uint = 0x10
+			if i+length > sectors {
+				length = sectors - i
+			}
+			addr := (block*rkDev.flashInfo.SectorPerBlock + i) << 8
+
+			secData := data[i*PhysicalSectorSize : (i+length)*PhysicalSectorSize]
+			err = rkDev.writeSector(uint32(addr), secData)
+			if err != nil {
+				return err
+			}
+
+			r, err := rkDev.readSector(uint32(addr), uint16(length))
+			if err != nil {
+				return err
+			}
+			err = compareSectorData(r, secData, uint32(addr))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compareSectorData compares the data part of the physical sectors read back
+// from the row address addr with the written ones. The spare bytes and the BCH
+// code are left out, the loader may change them.
+func compareSectorData(read []byte, written []byte, addr uint32) error {
+	if len(read) != len(written) {
+		return fmt.Errorf("error reading sector 0x%04X", addr)
+	}
+	for offset := 0; offset < len(written); offset += PhysicalSectorSize {
+		if !bytes.Equal(read[offset:offset+SectorSize], written[offset:offset+SectorSize]) {
+			return &ErrVerifyMismatch{"IDB", addr>>8 + uint32(offset/PhysicalSectorSize)}
+		}
+	}
+	return nil
+}
+
+// reloadIdB discards the cached IDB and reads it again from the device.
+func (rkDev *RkDevice) reloadIdB() error {
+	rkDev.idb.HasOldSec0 = false
+	rkDev.idb.HasOldSec1 = false
+	rkDev.idb.HasOldSec2 = false
+	rkDev.idb.HasOldSec3 = false
+	return rkDev.readIdB()
+}
@@ -0,0 +1,70 @@
+package usb
+
+import (
+	"fmt"
+	"github.com/gotmc/libusb"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const sysfsDevices = "/sys/bus/usb/devices"
+
+// Location returns the physical location of the device as bus and port path,
+// e.g. 1-1.4. Unlike the device address it stays the same when the device
+// re-enumerates. The port path is taken from sysfs, where it is not available
+// only the port number on the parent hub is used.
+func Location(device *libusb.Device) (string, error) {
+	bus, err := device.GetBusNumber()
+	if err != nil {
+		return "", err
+	}
+
+	address, err := device.GetDeviceAddress()
+	if err == nil {
+		path, ok := sysfsPortPath(bus, address)
+		if ok {
+			return path, nil
+		}
+	}
+
+	port, err := device.GetPortNumber()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", bus, port), nil
+}
+
+// sysfsPortPath looks up the sysfs name of the device with the bus number and
+// address, which is the bus and port path.
+func sysfsPortPath(bus int, address int) (string, bool) {
+	entries, err := ioutil.ReadDir(sysfsDevices)
+	if err != nil {
+		return "", false
+	}
+	prefix := fmt.Sprintf("%d-", bus)
+	for _, entry := range entries {
+		name := entry.Name()
+		// interfaces contain a colon, root hubs are named usbN
+		if !strings.HasPrefix(name, prefix) || strings.Contains(name, ":") {
+			continue
+		}
+		if readSysfsInt(filepath.Join(sysfsDevices, name, "devnum")) == address {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func readSysfsInt(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,37 @@
+package usb
+
+import (
+	"github.com/gotmc/libusb"
+	"rockchipr/rkusb"
+)
+
+const massStorageClass = 0x08
+
+// Mode returns the mode the device is enumerated in. A device that offers a
+// mass storage interface is in MSC mode, otherwise the lowest bit of bcdUSB
+// tells Maskrom and loader apart.
+func Mode(device *libusb.Device) (rkusb.UsbMode, error) {
+	dd, err := device.GetDeviceDescriptor()
+	if err != nil {
+		return rkusb.ModeMaskrom, err
+	}
+
+	ac, err := device.GetActiveConfigDescriptor()
+	if err != nil {
+		return rkusb.ModeMaskrom, err
+	}
+	for _, iface := range ac.SupportedInterfaces {
+		for _, id := range iface.InterfaceDescriptors {
+			if id.InterfaceClass == massStorageClass {
+				return rkusb.ModeMsc, nil
+			}
+		}
+	}
+
+	return rkusb.UsbModeFromBcd(uint16(dd.USBSpecification)), nil
+}
+
+// Mode returns the mode the device was enumerated in when it was opened.
+func (t *Transport) Mode() rkusb.UsbMode {
+	return t.mode
+}
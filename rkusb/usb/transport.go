@@ -0,0 +1,164 @@
+// Package usb implements the rkusb.Transport on top of libusb.
+package usb
+
+import (
+	"errors"
+	"github.com/gotmc/libusb"
+	"rockchipr/rkusb"
+	"time"
+)
+
+type Transport struct {
+	device  *libusb.Device
+	handle  *libusb.DeviceHandle
+	bulkIn  *libusb.EndpointDescriptor
+	bulkOut *libusb.EndpointDescriptor
+	iface   int
+	mode    rkusb.UsbMode
+}
+
+// Open opens the device and claims the first interface that offers a bulk in
+// and a bulk out endpoint.
+func Open(device *libusb.Device) (*Transport, error) {
+	dh, err := device.Open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ac, err := device.GetActiveConfigDescriptor()
+
+	if err != nil {
+		dh.Close()
+		return nil, err
+	}
+
+	mode, err := Mode(device)
+	if err != nil {
+		dh.Close()
+		return nil, err
+	}
+
+	t := &Transport{
+		device: device,
+		handle: dh,
+		mode:   mode,
+	}
+
+	interfaces := ac.SupportedInterfaces
+	for i := 0; i < len(interfaces) && !t.claimed(); i++ {
+		for j := 0; j < interfaces[i].NumAltSettings && !t.claimed(); j++ {
+			id := interfaces[i].InterfaceDescriptors[j]
+			for k := 0; k < id.NumEndpoints; k++ {
+				epd := id.EndpointDescriptors[k]
+				if epd.EndpointAddress&0x80 == 0 {
+					if t.bulkOut == nil {
+						t.bulkOut = epd
+					}
+				} else {
+					if t.bulkIn == nil {
+						t.bulkIn = epd
+					}
+				}
+				if t.claimed() {
+					err = dh.ClaimInterface(i)
+					if err != nil {
+						dh.Close()
+						return nil, err
+					}
+					t.iface = i
+					break
+				}
+			}
+		}
+	}
+
+	if !t.claimed() {
+		dh.Close()
+		return nil, errors.New("no bulk endpoints found")
+	}
+
+	return t, nil
+}
+
+func (t *Transport) claimed() bool {
+	return t.bulkIn != nil && t.bulkOut != nil
+}
+
+func (t *Transport) Device() *libusb.Device {
+	return t.device
+}
+
+func (t *Transport) BulkOut(data []byte, timeout time.Duration) (int, error) {
+	return t.handle.BulkTransferOut(t.bulkOut.EndpointAddress, data, milliseconds(timeout))
+}
+
+func (t *Transport) BulkIn(maxLength int, timeout time.Duration) ([]byte, error) {
+	data, n, err := t.handle.BulkTransferIn(t.bulkIn.EndpointAddress, maxLength, milliseconds(timeout))
+	if err != nil {
+		return nil, err
+	}
+	return data[0:n], nil
+}
+
+func (t *Transport) Control(requestType byte, request byte, value uint16, index uint16, data []byte, timeout time.Duration) (int, error) {
+	direction := libusb.HostToDevice
+	if requestType&0x80 != 0 {
+		direction = libusb.DeviceToHost
+	}
+
+	kind := libusb.Standard
+	switch requestType & 0x60 {
+	case 0x20:
+		kind = libusb.Class
+	case 0x40:
+		kind = libusb.Vendor
+	case 0x60:
+		kind = libusb.Reserved
+	}
+
+	recipient := libusb.DeviceRecipient
+	switch requestType & 0x1f {
+	case 0x01:
+		recipient = libusb.InterfaceRecipient
+	case 0x02:
+		recipient = libusb.EndpointRecipient
+	case 0x03:
+		recipient = libusb.OtherRecipient
+	}
+
+	// libusb takes the address of the first element, so an empty transfer
+	// still needs a backing buffer
+	buf := data
+	if len(buf) == 0 {
+		buf = make([]byte, 1)
+	}
+
+	return t.handle.ControlTransfer(libusb.BitmapRequestType(direction, kind, recipient),
+		request, value, index, buf, len(data), milliseconds(timeout))
+}
+
+// ResetEndpoints resets the device to clear stalled bulk endpoints. The go
+// binding does not offer libusb_clear_halt and a CLEAR_FEATURE request of our
+// own would leave the data toggle of libusb behind, a port reset starts both
+// sides from DATA0. libusb keeps the handle and the claimed interface.
+func (t *Transport) ResetEndpoints() error {
+	return t.handle.ResetDevice()
+}
+
+func (t *Transport) Close() error {
+	if t.handle == nil {
+		return nil
+	}
+	err := t.handle.ReleaseInterface(t.iface)
+	closeErr := t.handle.Close()
+	t.handle = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func milliseconds(timeout time.Duration) int {
+	return int(timeout / time.Millisecond)
+}
@@ -3,133 +3,322 @@ package main
 import (
 	"fmt"
 	"github.com/akamensky/argparse"
-	"github.com/gotmc/libusb"
+	"github.com/gosuri/uiprogress"
 	"log"
 	"os"
+	"rockchipr/rkusb"
+	"strings"
+	"time"
 )
 
+// progressBars renders the progress reported by rkusb for one device with
+// one bar per operation and item.
+type progressBars struct {
+	device string
+	bars   map[string]*uiprogress.Bar
+}
+
+func newProgressBars(device string) *progressBars {
+	return &progressBars{device: device, bars: map[string]*uiprogress.Bar{}}
+}
+
+func (p *progressBars) update(operation string, name string, done int, total int) {
+	key := operation + "/" + name
+	bar, ok := p.bars[key]
+	if !ok {
+		title := fmt.Sprintf("%8s %8s: %10s", p.device, operation, name)
+		bar = uiprogress.AddBar(total).PrependFunc(func(b *uiprogress.Bar) string {
+			return title
+		}).AppendCompleted()
+		p.bars[key] = bar
+	}
+	bar.Set(done)
+}
+
+func printLoader(loader *rkusb.RkLoader) {
+	fmt.Printf("        Chip: %s\n", loader.ChipName())
+	fmt.Printf("     Version: %s\n", loader.Version())
+	fmt.Printf("Release time: %s\n", loader.ReleaseTime().Format("2006-01-02 15:04:05"))
+	fmt.Printf("       CRC32: 0x%08X\n", loader.Crc32)
+	fmt.Printf("         RC4: %v\n", !loader.Rc4Disabled())
+	entries := []struct {
+		kind    string
+		entries []rkusb.RkLoaderEntry
+	}{
+		{"471", loader.Entries471},
+		{"472", loader.Entries472},
+		{"loader", loader.Loaders},
+	}
+	for _, group := range entries {
+		for _, entry := range group.entries {
+			fmt.Printf("%6s %-12s offset 0x%08X size 0x%08X delay %dms\n",
+				group.kind, entry.Name, entry.DataOffset, entry.DataSize, entry.DataDelay)
+		}
+	}
+}
+
+// globalValueFlags are the global flags that take a value, positionalArgs
+// skips the value when it looks for the command.
+var globalValueFlags = map[string]bool{
+	"-v": true, "--vendor-id": true,
+	"-p": true, "--product-id": true,
+	"-o": true, "--output": true,
+	"--bus": true, "--port-path": true, "--sn": true,
+	"--boot-loader": true, "--timeout": true, "--retries": true, "--rearm": true,
+}
+
+// commandIndex returns the index of command in args, skipping the global flags
+// and their values before it, or -1 if args holds another command.
+func commandIndex(args []string, command string) int {
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == command:
+			return i
+		case !strings.HasPrefix(arg, "-"):
+			return -1
+		case globalValueFlags[arg]:
+			i++
+		}
+	}
+	return -1
+}
+
+// positionalArgs turns the positional arguments that directly follow command
+// into the flags argparse understands, read-lba 0 16 out.bin becomes
+// read-lba --start 0 --count 16 --file out.bin.
+func positionalArgs(args []string, command string, flags ...string) []string {
+	c := commandIndex(args, command)
+	if c < 0 {
+		return args
+	}
+
+	result := append([]string{}, args[:c+1]...)
+	i := c + 1
+	for _, flag := range flags {
+		if i >= len(args) || strings.HasPrefix(args[i], "-") {
+			break
+		}
+		result = append(result, flag, args[i])
+		i++
+	}
+	return append(result, args[i:]...)
+}
+
 func main() {
 	log.SetPrefix("rockchipr: ")
 	log.SetFlags(0)
 
-	// Create new parser object
-	parser := argparse.NewParser("print", "Prints provided string to stdout")
-	// Create string flag
+	parser := argparse.NewParser("rockchipr", "Tool for Rockchip devices in loader mode")
 	vid := parser.Int("v", "vendor-id", &argparse.Options{Required: false, Help: "Vendor ID of the USB device, defaults to 0x2207", Default: 0x2207})
-	pid := parser.Int("p", "product-id", &argparse.Options{Required: false, Help: "Product ID of the USB device, defaults to 0x310C", Default: 0x310C})
+	pid := parser.Int("p", "product-id", &argparse.Options{Required: false, Help: "Product ID of the USB device, by default every known Rockchip device is used", Default: 0})
+	output := parser.Selector("o", "output", []string{"text", "json"}, &argparse.Options{Required: false, Help: "Format of the device report, text or json", Default: "text"})
+	watch := parser.Flag("w", "watch", &argparse.Options{Required: false, Help: "Keep running and process every device that is attached", Default: false})
+	bus := parser.Int("", "bus", &argparse.Options{Required: false, Help: "Only use devices on this USB bus", Default: 0})
+	portPath := parser.String("", "port-path", &argparse.Options{Required: false, Help: "Only use the device at this USB port path, as printed by list"})
+	selectSn := parser.String("", "sn", &argparse.Options{Required: false, Help: "Only use the device with this serial number in the IDB"})
+	bootLoader := parser.File("", "boot-loader", os.O_RDONLY, 0400, &argparse.Options{Required: false, Help: "Loader (RKBOOT) to download to devices in Maskrom mode before the command", Default: nil})
+	timeout := parser.Int("", "timeout", &argparse.Options{Required: false, Help: "Timeout in seconds of every USB transfer, by default it depends on the command", Default: 0})
+	retries := parser.Int("", "retries", &argparse.Options{Required: false, Help: "How often a read command is repeated after a USB transfer error", Default: rkusb.DefaultRetries})
+	rearm := parser.Int("", "rearm", &argparse.Options{Required: false, Help: "Seconds a USB port has to be empty before a device on it is processed again in watch mode", Default: 10})
 
-	img := parser.File("f", "rk-image", os.O_RDONLY, 0400, &argparse.Options{Required: false, Help: "Image to flash", Default: nil})
+	listCmd := parser.NewCommand("list", "List the matching devices")
 
-	sn := parser.String("s", "sn", &argparse.Options{Required: false, Help: "Serial number to set"})
-	imei := parser.String("i", "imei", &argparse.Options{Required: false, Help: "IMEI to set"})
-	uid := parser.String("u", "uid", &argparse.Options{Required: false, Help: "UID to set"})
-	bt := parser.String("b", "bt", &argparse.Options{Required: false, Help: "Bluetooth address to set"})
-	mac := parser.String("m", "mac", &argparse.Options{Required: false, Help: "MAC address to set"})
+	infoCmd := parser.NewCommand("info", "Print chip, flash and IDB information of the devices")
 
-	r := parser.Flag("r", "reset", &argparse.Options{Required: false, Help: "Reset the device (after operation)", Default: false})
+	loaderInfoCmd := parser.NewCommand("loader-info", "Print the content of a loader (RKBOOT) file")
+	loaderInfoFile := loaderInfoCmd.File("l", "loader", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "Loader (RKBOOT) file"})
 
-	// Parse input
-	err := parser.Parse(os.Args)
-	if err != nil {
-		// In case of error print error and print usage
-		// This can also be done by passing -h or --help flags
-		fmt.Print(parser.Usage(err))
-	}
+	bootCmd := parser.NewCommand("download-boot", "Download a loader to devices in Maskrom mode")
+	bootFile := bootCmd.File("l", "loader", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "Loader (RKBOOT) file"})
 
-	var rkImage *RkImage
+	upgradeCmd := parser.NewCommand("upgrade-loader", "Write a loader into the IDB, keeping the device identity")
+	upgradeFile := upgradeCmd.File("l", "loader", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "Loader (RKBOOT) file"})
 
-	if !argparse.IsNilFile(img) {
-		rkImage, err = Open(img)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
+	rebuildCmd := parser.NewCommand("rebuild-idb", "Build a new IDB from a loader, also works on blank or corrupted NAND")
+	rebuildFile := rebuildCmd.File("l", "loader", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "Loader (RKBOOT) file"})
+
+	flashCmd := parser.NewCommand("flash", "Write an update image to the devices")
+	flashFile := flashCmd.File("f", "rk-image", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "Image to flash"})
+	flashReset := flashCmd.Flag("r", "reset", &argparse.Options{Required: false, Help: "Reset the device after flashing", Default: false})
+	flashSn := flashCmd.String("s", "serial", &argparse.Options{Required: false, Help: "Serial number to set before flashing"})
+	flashImei := flashCmd.String("i", "imei", &argparse.Options{Required: false, Help: "IMEI to set before flashing"})
+	flashUid := flashCmd.String("u", "uid", &argparse.Options{Required: false, Help: "UID to set before flashing"})
+	flashBt := flashCmd.String("b", "bt", &argparse.Options{Required: false, Help: "Bluetooth address to set before flashing"})
+	flashMac := flashCmd.String("m", "mac", &argparse.Options{Required: false, Help: "MAC address to set before flashing"})
+	flashPartition := flashCmd.String("", "partition", &argparse.Options{Required: false, Help: "Comma separated parts to write, e.g. boot,recovery, the parameter is only written when named"})
+	flashSkip := flashCmd.String("", "skip", &argparse.Options{Required: false, Help: "Comma separated parts not to write, e.g. parameter,userdata"})
+	flashNoLayoutCheck := flashCmd.Flag("", "no-layout-check", &argparse.Options{Required: false, Help: "Do not check the parts against the parameter, for devices without a readable one", Default: false})
+
+	setIdCmd := parser.NewCommand("set-id", "Change the identity stored in IDB sector 3")
+	sn := setIdCmd.String("s", "serial", &argparse.Options{Required: false, Help: "Serial number to set"})
+	imei := setIdCmd.String("i", "imei", &argparse.Options{Required: false, Help: "IMEI to set"})
+	uid := setIdCmd.String("u", "uid", &argparse.Options{Required: false, Help: "UID to set"})
+	bt := setIdCmd.String("b", "bt", &argparse.Options{Required: false, Help: "Bluetooth address to set"})
+	mac := setIdCmd.String("m", "mac", &argparse.Options{Required: false, Help: "MAC address to set"})
+
+	readLbaCmd := parser.NewCommand("read-lba", "Read sectors of 512 bytes from the device to a file: read-lba <start> <count> <file>")
+	readLbaStart := readLbaCmd.String("s", "start", &argparse.Options{Required: true, Help: "First sector, decimal or 0x prefixed hex"})
+	readLbaCount := readLbaCmd.String("c", "count", &argparse.Options{Required: true, Help: "Number of sectors, decimal or 0x prefixed hex"})
+	readLbaFile := readLbaCmd.File("f", "file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600, &argparse.Options{Required: true, Help: "File to write the sectors to"})
+	readLbaReserved := readLbaCmd.Flag("r", "reserved", &argparse.Options{Required: false, Help: "Set the reserved flag of the commands, used for the system partition", Default: false})
+
+	writeLbaCmd := parser.NewCommand("write-lba", "Write a file to the device: write-lba <start> <file>")
+	writeLbaStart := writeLbaCmd.String("s", "start", &argparse.Options{Required: true, Help: "First sector, decimal or 0x prefixed hex"})
+	writeLbaFile := writeLbaCmd.File("f", "file", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "File to write"})
+	writeLbaReserved := writeLbaCmd.Flag("r", "reserved", &argparse.Options{Required: false, Help: "Set the reserved flag of the commands, used for the system partition", Default: false})
+
+	eraseCmd := parser.NewCommand("erase", "Erase flash blocks, bad blocks are skipped")
+	eraseBlock := eraseCmd.String("s", "block", &argparse.Options{Required: true, Help: "First block, decimal or 0x prefixed hex"})
+	eraseCount := eraseCmd.String("c", "count", &argparse.Options{Required: false, Help: "Number of blocks", Default: "1"})
+
+	dumpIdbCmd := parser.NewCommand("dump-idb", "Write the raw sectors of all ID blocks to a file")
+	dumpIdbFile := dumpIdbCmd.File("f", "file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600, &argparse.Options{Required: true, Help: "Dump file"})
+
+	restoreIdbCmd := parser.NewCommand("restore-idb", "Write the ID blocks of a dump created with dump-idb back to the device")
+	restoreIdbFile := restoreIdbCmd.File("f", "file", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "Dump file"})
+
+	parameterCmd := parser.NewCommand("parameter", "Print the parameter and partition table of an update image or of the device")
+	parameterFile := parameterCmd.File("f", "rk-image", os.O_RDONLY, 0400, &argparse.Options{Required: false, Help: "Update image to read the parameter from instead of the device"})
+
+	buildParamCmd := parser.NewCommand("build-parameter", "Build a parameter file from a partition list and header fields")
+	buildParamFile := buildParamCmd.File("f", "file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600, &argparse.Options{Required: true, Help: "File to write the PARM blob to"})
+	buildParamFrom := buildParamCmd.File("", "from", os.O_RDONLY, 0400, &argparse.Options{Required: false, Help: "Parameter file to take the fields and partitions from"})
+	buildParamParts := buildParamCmd.String("", "partitions", &argparse.Options{Required: false, Help: "Comma separated name=size[@offset], size - grows to the end, e.g. misc=0x2000@0x2000,boot=0x8000,userdata=-"})
+	buildParamFwVer := buildParamCmd.String("", "firmware-ver", &argparse.Options{Required: false, Help: "FIRMWARE_VER"})
+	buildParamModel := buildParamCmd.String("", "machine-model", &argparse.Options{Required: false, Help: "MACHINE_MODEL"})
+	buildParamMachineId := buildParamCmd.String("", "machine-id", &argparse.Options{Required: false, Help: "MACHINE_ID"})
+	buildParamManufacturer := buildParamCmd.String("", "manufacturer", &argparse.Options{Required: false, Help: "MANUFACTURER"})
+	buildParamMagic := buildParamCmd.String("", "magic", &argparse.Options{Required: false, Help: "MAGIC"})
+	buildParamAtag := buildParamCmd.String("", "atag", &argparse.Options{Required: false, Help: "ATAG"})
+	buildParamMachine := buildParamCmd.String("", "machine", &argparse.Options{Required: false, Help: "MACHINE"})
+	buildParamCheckMask := buildParamCmd.String("", "check-mask", &argparse.Options{Required: false, Help: "CHECK_MASK"})
+	buildParamKernelImg := buildParamCmd.String("", "kernel-img", &argparse.Options{Required: false, Help: "KERNEL_IMG"})
+	buildParamCmdLine := buildParamCmd.String("", "cmdline", &argparse.Options{Required: false, Help: "CMDLINE without mtdparts, the mtdparts option is built from the partitions"})
+
+	writeParamCmd := parser.NewCommand("write-parameter", "Write a parameter file to the devices and verify it")
+	writeParamFile := writeParamCmd.File("f", "file", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "Parameter file, PARM blob or text"})
+
+	gptCmd := parser.NewCommand("gpt", "Print the GPT of the device")
+
+	writeGptCmd := parser.NewCommand("write-gpt", "Convert the partitions of a parameter file to a GPT and write it to the device")
+	writeGptFile := writeGptCmd.File("f", "file", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "Parameter file, PARM blob or text"})
+	writeGptForce := writeGptCmd.Flag("", "force", &argparse.Options{Required: false, Help: "Write the GPT even though it overwrites the parameter at LBA 0", Default: false})
+
+	backupCmd := parser.NewCommand("backup", "Read the whole logical space and the ID blocks, the sidecar <file>.json describes the device and <file>.idb holds the ID blocks")
+	backupFile := backupCmd.File("f", "file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600, &argparse.Options{Required: true, Help: "Backup image"})
+
+	restoreCmd := parser.NewCommand("restore", "Write a backup created with backup back to the logical space and verify it")
+	restoreFile := restoreCmd.File("f", "file", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "Backup image, <file>.json has to exist next to it"})
 
-	ctx, err := libusb.NewContext()
+	unpackCmd := parser.NewCommand("unpack", "Extract the parts, the package-file and the loader of an update image: unpack <update.img> <dir>")
+	unpackFile := unpackCmd.File("f", "rk-image", os.O_RDONLY, 0400, &argparse.Options{Required: true, Help: "Update image to unpack"})
+	unpackDir := unpackCmd.String("d", "dir", &argparse.Options{Required: true, Help: "Directory to extract to, it is created if needed"})
 
+	resetCmd := parser.NewCommand("reset", "Reset the devices")
+
+	args := positionalArgs(os.Args, "read-lba", "--start", "--count", "--file")
+	args = positionalArgs(args, "write-lba", "--start", "--file")
+	args = positionalArgs(args, "unpack", "--rk-image", "--dir")
+	err := parser.Parse(args)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Print(parser.Usage(err))
+		os.Exit(1)
 	}
 
-	devices, err := ctx.GetDeviceList()
-	if err != nil {
-		log.Fatal(err)
+	// status messages go to stderr when stdout carries the json report
+	status := os.Stdout
+	if *output == "json" {
+		status = os.Stderr
 	}
 
-	for i := 0; i < len(devices); i++ {
-		device := devices[i]
-		dd, err := device.GetDeviceDescriptor()
+	cli := &cli{
+		vid:      uint16(*vid),
+		pid:      uint16(*pid),
+		json:     *output == "json",
+		status:   status,
+		watch:    *watch,
+		rearm:    time.Duration(*rearm) * time.Second,
+		bus:      *bus,
+		portPath: *portPath,
+		sn:       *selectSn,
+		timeout:  time.Duration(*timeout) * time.Second,
+		retries:  *retries,
+	}
 
+	if !argparse.IsNilFile(bootLoader) {
+		cli.bootLoader, err = rkusb.OpenLoader(bootLoader)
 		if err != nil {
-			log.Fatalln(err)
+			log.Fatal(err)
 		}
+	}
 
-		if dd.VendorID == uint16(*vid) && dd.ProductID == uint16(*pid) {
-			rkDev := CreateRkDevice(device)
-
-			err = rkDev.Open()
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			err = rkDev.ReadDeviceData()
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			fmt.Println("Found device")
-			fmt.Printf("  SN: %s\n", rkDev.GetSerialNo())
-			fmt.Printf(" UID: %s\n", rkDev.GetUID())
-			fmt.Printf("IMEI: %s\n", rkDev.GetIMEI())
-			fmt.Printf(" MAC: %s\n", rkDev.GetMacAddress())
-			fmt.Printf("  BT: %s\n", rkDev.GetBtAddress())
-			changedSec3 := false
-			if len(*sn) > 0 {
-				rkDev.SetSerialNo(*sn)
-				changedSec3 = true
-			}
-			if len(*imei) > 0 {
-				rkDev.SetImei(*imei)
-				changedSec3 = true
-			}
-			if len(*uid) > 0 {
-				rkDev.SetUid(*uid)
-				changedSec3 = true
-			}
-			if len(*mac) > 0 {
-				rkDev.SetMacAddr(*mac)
-				changedSec3 = true
-			}
-			if len(*bt) > 0 {
-				rkDev.SetBtAddr(*bt)
-				changedSec3 = true
-			}
-
-			if changedSec3 {
-				// write idb
-				err = rkDev.WriteDeviceData()
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-
-			if rkImage != nil {
-				// flash new image
-				err := rkDev.WriteImage(rkImage)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-
-			if *r {
-				err := rkDev.ResetDevice()
-				if err != nil {
-					log.Fatal(err)
-				}
-				continue
-			}
+	switch {
+	case listCmd.Happened():
+		err = cli.list()
+	case infoCmd.Happened():
+		err = cli.info()
+	case loaderInfoCmd.Happened():
+		err = cli.loaderInfo(loaderInfoFile)
+	case bootCmd.Happened():
+		err = cli.downloadBoot(bootFile)
+	case upgradeCmd.Happened():
+		err = cli.upgradeLoader(upgradeFile)
+	case rebuildCmd.Happened():
+		err = cli.rebuildIdb(rebuildFile)
+	case flashCmd.Happened():
+		filter := rkusb.PartFilter{Partitions: splitNames(*flashPartition), Skip: splitNames(*flashSkip), NoLayoutCheck: *flashNoLayoutCheck}
+		err = cli.flash(flashFile, filter, identity{sn: *flashSn, imei: *flashImei, uid: *flashUid, bt: *flashBt, mac: *flashMac}, *flashReset)
+	case setIdCmd.Happened():
+		err = cli.setId(identity{sn: *sn, imei: *imei, uid: *uid, bt: *bt, mac: *mac})
+	case readLbaCmd.Happened():
+		err = cli.readLba(*readLbaStart, *readLbaCount, readLbaFile, *readLbaReserved)
+	case writeLbaCmd.Happened():
+		err = cli.writeLba(*writeLbaStart, writeLbaFile, *writeLbaReserved)
+	case eraseCmd.Happened():
+		err = cli.erase(*eraseBlock, *eraseCount)
+	case dumpIdbCmd.Happened():
+		err = cli.dumpIdb(dumpIdbFile)
+	case restoreIdbCmd.Happened():
+		err = cli.restoreIdb(restoreIdbFile)
+	case parameterCmd.Happened():
+		if argparse.IsNilFile(parameterFile) {
+			parameterFile = nil
+		}
+		err = cli.parameter(parameterFile)
+	case buildParamCmd.Happened():
+		header := map[string]string{
+			"FIRMWARE_VER":  *buildParamFwVer,
+			"MACHINE_MODEL": *buildParamModel,
+			"MACHINE_ID":    *buildParamMachineId,
+			"MANUFACTURER":  *buildParamManufacturer,
+			"MAGIC":         *buildParamMagic,
+			"ATAG":          *buildParamAtag,
+			"MACHINE":       *buildParamMachine,
+			"CHECK_MASK":    *buildParamCheckMask,
+			"KERNEL_IMG":    *buildParamKernelImg,
+			"CMDLINE":       *buildParamCmdLine,
 		}
+		if argparse.IsNilFile(buildParamFrom) {
+			buildParamFrom = nil
+		}
+		err = cli.buildParameter(buildParamFile, buildParamFrom, *buildParamParts, header)
+	case writeParamCmd.Happened():
+		err = cli.writeParameter(writeParamFile)
+	case gptCmd.Happened():
+		err = cli.gpt()
+	case writeGptCmd.Happened():
+		err = cli.writeGpt(writeGptFile, *writeGptForce)
+	case backupCmd.Happened():
+		err = cli.backup(backupFile)
+	case restoreCmd.Happened():
+		err = cli.restore(restoreFile)
+	case unpackCmd.Happened():
+		err = cli.unpack(unpackFile, *unpackDir)
+	case resetCmd.Happened():
+		err = cli.reset()
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	fmt.Println()
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPositionalArgs(t *testing.T) {
+	tests := []struct {
+		args    string
+		command string
+		flags   []string
+		want    string
+	}{
+		{"rockchipr read-lba 0 16 out.bin", "read-lba", []string{"--start", "--count", "--file"},
+			"rockchipr read-lba --start 0 --count 16 --file out.bin"},
+		{"rockchipr --port-path 1-1.4 read-lba 0 16 out.bin", "read-lba", []string{"--start", "--count", "--file"},
+			"rockchipr --port-path 1-1.4 read-lba --start 0 --count 16 --file out.bin"},
+		{"rockchipr -o json read-lba 0x40 16 out.bin -r", "read-lba", []string{"--start", "--count", "--file"},
+			"rockchipr -o json read-lba --start 0x40 --count 16 --file out.bin -r"},
+		{"rockchipr -w --sn read-lba write-lba 0 in.bin", "write-lba", []string{"--start", "--file"},
+			"rockchipr -w --sn read-lba write-lba --start 0 --file in.bin"},
+		{"rockchipr --bus 3 unpack update.img out", "unpack", []string{"--rk-image", "--dir"},
+			"rockchipr --bus 3 unpack --rk-image update.img --dir out"},
+		{"rockchipr read-lba --start 0 --count 16 --file out.bin", "read-lba", []string{"--start", "--count", "--file"},
+			"rockchipr read-lba --start 0 --count 16 --file out.bin"},
+		{"rockchipr info", "read-lba", []string{"--start", "--count", "--file"},
+			"rockchipr info"},
+		{"rockchipr flash -f read-lba", "read-lba", []string{"--start", "--count", "--file"},
+			"rockchipr flash -f read-lba"},
+	}
+	for _, test := range tests {
+		got := positionalArgs(strings.Fields(test.args), test.command, test.flags...)
+		if want := strings.Fields(test.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, want %q", test.args, got, want)
+		}
+	}
+}